@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	pathlib "path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+)
+
+const (
+	// CoreFound means the MRA will load the RBF in RbfPath.
+	CoreFound = "found"
+	// CoreMissing means no RBF in the arcade cores folder matches the MRA.
+	CoreMissing = "missing"
+	// CoreAmbiguous means several different cores match the MRA, RbfPath
+	// holds the newest one.
+	CoreAmbiguous = "ambiguous"
+)
+
+// arcadeCoreNames returns the file name prefixes the MiSTer accepts for the
+// rbf referenced by an MRA.
+func arcadeCoreNames(rbf string) []string {
+	rbf = strings.ToLower(rbf)
+	return []string{rbf, "arcade-" + rbf}
+}
+
+func matchesArcadeCore(filename string, rbf string) bool {
+	filename = strings.ToLower(filename)
+	for _, name := range arcadeCoreNames(rbf) {
+		if filename == name+".rbf" || strings.HasPrefix(filename, name+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveArcadeCores finds the RBF each MRA will load among the cores in
+// the arcade cores folder, picking the newest build when there are several.
+func resolveArcadeCores(mras []MRA, rbfs []RBF) {
+	arcadeCores := make([]RBF, 0)
+	for _, c := range rbfs {
+		if pathlib.Dir(c.Path) == system.ArcadeCoresPath {
+			arcadeCores = append(arcadeCores, c)
+		}
+	}
+
+	for i := range mras {
+		m := &mras[i]
+		m.RbfPath = ""
+		m.CoreStatus = CoreMissing
+		if m.Rbf == "" {
+			continue
+		}
+
+		var newest *RBF
+		codenames := make(map[string]bool)
+		for j := range arcadeCores {
+			c := &arcadeCores[j]
+			if !matchesArcadeCore(c.Filename, m.Rbf) {
+				continue
+			}
+			codenames[strings.ToLower(c.Codename)] = true
+			if newest == nil || c.Codedate > newest.Codedate || (c.Codedate == newest.Codedate && c.Ctime > newest.Ctime) {
+				newest = c
+			}
+		}
+		if newest == nil {
+			continue
+		}
+
+		m.RbfPath = newest.Path
+		m.CoreStatus = CoreFound
+		if len(codenames) > 1 {
+			m.CoreStatus = CoreAmbiguous
+		}
+	}
+}
+
+// ArcadeFamily groups a parent MRA with its clones and alternative versions.
+type ArcadeFamily struct {
+	ID     string   `json:"id"`
+	Parent string   `json:"parent"`
+	Clones []string `json:"clones"`
+}
+
+// alternativeOf returns the folder name inside _alternatives holding the MRA,
+// which is the name of the game it is an alternative of.
+func alternativeOf(m *MRA) (string, bool) {
+	for i, d := range m.LogicPath {
+		if strings.ToLower(d) == "alternatives" && i+1 < len(m.LogicPath) {
+			return m.LogicPath[i+1], true
+		}
+	}
+	return "", false
+}
+
+// familyOf returns the identifier of the family of an MRA that is not an
+// alternative version.
+func familyOf(m *MRA) string {
+	switch {
+	case m.Parent != "":
+		return strings.ToLower(m.Parent)
+	case m.Setname != "":
+		return strings.ToLower(m.Setname)
+	default:
+		return m.Path
+	}
+}
+
+// groupArcadeFamilies assigns every MRA to a family, using the parent and
+// setname of the MRA and the _alternatives folder it is in.
+func groupArcadeFamilies(mras []MRA) []ArcadeFamily {
+	byName := make(map[string]*MRA)
+	for i := range mras {
+		m := &mras[i]
+		if _, ok := alternativeOf(m); ok {
+			continue
+		}
+		for _, name := range []string{m.Name, strings.TrimSuffix(m.Filename, pathlib.Ext(m.Filename))} {
+			if _, ok := byName[strings.ToLower(name)]; name != "" && !ok {
+				byName[strings.ToLower(name)] = m
+			}
+		}
+	}
+
+	families := make(map[string]*ArcadeFamily)
+	ids := make([]string, 0)
+	for i := range mras {
+		m := &mras[i]
+		isAlternative := false
+		if game, ok := alternativeOf(m); ok {
+			isAlternative = true
+			if main, ok := byName[strings.ToLower(game)]; ok {
+				m.Family = familyOf(main)
+			} else if m.Parent != "" {
+				m.Family = strings.ToLower(m.Parent)
+			} else {
+				m.Family = "alternatives/" + strings.ToLower(game)
+			}
+		} else {
+			m.Family = familyOf(m)
+		}
+
+		f, ok := families[m.Family]
+		if !ok {
+			f = &ArcadeFamily{ID: m.Family, Clones: make([]string, 0)}
+			families[m.Family] = f
+			ids = append(ids, m.Family)
+		}
+		isParent := !isAlternative && m.Parent == "" && f.Parent == ""
+		if isParent {
+			f.Parent = m.Path
+		}
+		m.Clone = !isParent
+	}
+
+	for i := range mras {
+		m := &mras[i]
+		if m.Clone {
+			f := families[m.Family]
+			f.Clones = append(f.Clones, m.Path)
+		}
+	}
+
+	sort.Strings(ids)
+	result := make([]ArcadeFamily, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, *families[id])
+	}
+	return result
+}
+
+// RomZip is an arcade ROM zip together with the MRAs using it.
+type RomZip struct {
+	Path string   `json:"path"`
+	Size int64    `json:"size"`
+	MRAs []string `json:"mras"`
+}
+
+// MissingRomZips is an MRA for which none of its ROM zips were found.
+type MissingRomZips struct {
+	MRA  string   `json:"mra"`
+	Zips []string `json:"zips"`
+}
+
+// RomZipReport tells which arcade ROM zips are used by the installed MRAs.
+type RomZipReport struct {
+	Zips             []RomZip         `json:"zips"`
+	Unreferenced     []string         `json:"unreferenced"`
+	UnreferencedSize int64            `json:"unreferenced_size"`
+	Missing          []MissingRomZips `json:"missing"`
+}
+
+// BuildRomZipReport lists every zip in the folders where the MRAs look for
+// their ROMs and matches them with the zips found by the MRA scan.
+func BuildRomZipReport(mras []MRA) RomZipReport {
+	report := RomZipReport{
+		Zips:         make([]RomZip, 0),
+		Unreferenced: make([]string, 0),
+		Missing:      make([]MissingRomZips, 0),
+	}
+
+	dirs := make(map[string]bool)
+	for _, dir := range romZipDirs(system.SdPath) {
+		dirs[dir] = true
+	}
+	usage := make(map[string][]string)
+	for _, m := range mras {
+		for _, dir := range romZipDirs(pathlib.Dir(m.Path)) {
+			dirs[dir] = true
+		}
+		for _, z := range m.Zips {
+			usage[z] = append(usage[z], m.Path)
+		}
+		if m.Audit.Status == AuditNoZip {
+			missing := MissingRomZips{MRA: m.Path, Zips: make([]string, 0)}
+			for _, rom := range m.Roms {
+				if rom.Zip != "" {
+					missing.Zips = append(missing.Zips, strings.Split(rom.Zip, "|")...)
+				}
+			}
+			report.Missing = append(report.Missing, missing)
+		}
+	}
+
+	for dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if !f.Mode().IsRegular() || strings.ToLower(pathlib.Ext(f.Name())) != ".zip" {
+				continue
+			}
+			z := RomZip{
+				Path: pathlib.Join(dir, f.Name()),
+				Size: f.Size(),
+				MRAs: usage[pathlib.Join(dir, f.Name())],
+			}
+			if z.MRAs == nil {
+				z.MRAs = make([]string, 0)
+				report.Unreferenced = append(report.Unreferenced, z.Path)
+				report.UnreferencedSize += z.Size
+			}
+			report.Zips = append(report.Zips, z)
+		}
+	}
+	sort.Slice(report.Zips, func(i, j int) bool { return report.Zips[i].Path < report.Zips[j].Path })
+	sort.Strings(report.Unreferenced)
+
+	return report
+}
+
+// WriteCSV writes the report as one row per zip and MRA pair.
+func (report RomZipReport) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"status", "zip", "size", "mra"})
+	for _, z := range report.Zips {
+		if len(z.MRAs) == 0 {
+			out.Write([]string{"unreferenced", z.Path, strconv.FormatInt(z.Size, 10), ""})
+		}
+		for _, m := range z.MRAs {
+			out.Write([]string{"used", z.Path, strconv.FormatInt(z.Size, 10), m})
+		}
+	}
+	for _, m := range report.Missing {
+		for _, z := range m.Zips {
+			out.Write([]string{"missing", z, "", m.MRA})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func GetRomZipReport(w http.ResponseWriter, r *http.Request) {
+	cores, err := LoadCores()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	report := BuildRomZipReport(cores.MRAs)
+
+	format, ok := r.URL.Query()["format"]
+	if ok && format[0] == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"romzips.csv\"")
+		report.WriteCSV(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"romzips.json\"")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	pathlib "path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveArcadeCores(t *testing.T) {
+	rbfs := []RBF{
+		{Path: "/media/fat/_Arcade/cores/Arcade-Pacman_20200101.rbf", Filename: "Arcade-Pacman_20200101.rbf", Codename: "Arcade-Pacman", Codedate: "20200101"},
+		{Path: "/media/fat/_Arcade/cores/Arcade-Pacman_20210101.rbf", Filename: "Arcade-Pacman_20210101.rbf", Codename: "Arcade-Pacman", Codedate: "20210101"},
+		{Path: "/media/fat/_Arcade/cores/galaga_20200101.rbf", Filename: "galaga_20200101.rbf", Codename: "galaga", Codedate: "20200101"},
+		{Path: "/media/fat/_Arcade/cores/Arcade-Galaga_20210101.rbf", Filename: "Arcade-Galaga_20210101.rbf", Codename: "Arcade-Galaga", Codedate: "20210101"},
+		{Path: "/media/fat/_Arcade/cores/Arcade-DonkeyKong.rbf", Filename: "Arcade-DonkeyKong.rbf"},
+		// Only the arcade cores folder counts
+		{Path: "/media/fat/_Console/Pacman_20220101.rbf", Filename: "Pacman_20220101.rbf", Codename: "Pacman", Codedate: "20220101"},
+	}
+	tests := []struct {
+		rbf    string
+		status string
+		path   string
+	}{
+		{"pacman", CoreFound, "/media/fat/_Arcade/cores/Arcade-Pacman_20210101.rbf"},
+		{"PACMAN", CoreFound, "/media/fat/_Arcade/cores/Arcade-Pacman_20210101.rbf"},
+		{"galaga", CoreAmbiguous, "/media/fat/_Arcade/cores/Arcade-Galaga_20210101.rbf"},
+		{"donkeykong", CoreFound, "/media/fat/_Arcade/cores/Arcade-DonkeyKong.rbf"},
+		{"pacmania", CoreMissing, ""},
+		{"", CoreMissing, ""},
+	}
+	mras := make([]MRA, len(tests))
+	for i, tt := range tests {
+		mras[i] = MRA{Rbf: tt.rbf, RbfPath: "stale", CoreStatus: CoreFound}
+	}
+	resolveArcadeCores(mras, rbfs)
+	for i, tt := range tests {
+		if mras[i].CoreStatus != tt.status || mras[i].RbfPath != tt.path {
+			t.Errorf("%q: %s %q, want %s %q", tt.rbf, mras[i].CoreStatus, mras[i].RbfPath, tt.status, tt.path)
+		}
+	}
+}
+
+func TestGroupArcadeFamilies(t *testing.T) {
+	mras := []MRA{
+		{Path: "/media/fat/_Arcade/Pac-Man (Midway).mra", Filename: "Pac-Man (Midway).mra", Name: "Pac-Man (Midway)", Setname: "pacman", Parent: "puckman", LogicPath: []string{"Arcade"}},
+		{Path: "/media/fat/_Arcade/Pac-Man.mra", Filename: "Pac-Man.mra", Name: "Pac-Man", Setname: "puckman", LogicPath: []string{"Arcade"}},
+		{Path: "/media/fat/_Arcade/_alternatives/_Pac-Man/Pac-Man (hack).mra", Filename: "Pac-Man (hack).mra", Name: "Pac-Man (hack)", Setname: "pachack", LogicPath: []string{"Arcade", "alternatives", "Pac-Man"}},
+		{Path: "/media/fat/_Arcade/_alternatives/_Lost/Lost (alt).mra", Filename: "Lost (alt).mra", LogicPath: []string{"Arcade", "alternatives", "Lost"}},
+		{Path: "/media/fat/_Arcade/Galaga.mra", Filename: "Galaga.mra", Name: "Galaga", Setname: "galaga", LogicPath: []string{"Arcade"}},
+		{Path: "/media/fat/_Arcade/Solo.mra", Filename: "Solo.mra", LogicPath: []string{"Arcade"}},
+	}
+	families := groupArcadeFamilies(mras)
+
+	want := []ArcadeFamily{
+		{ID: "/media/fat/_Arcade/Solo.mra", Parent: "/media/fat/_Arcade/Solo.mra", Clones: []string{}},
+		{ID: "alternatives/lost", Clones: []string{"/media/fat/_Arcade/_alternatives/_Lost/Lost (alt).mra"}},
+		{ID: "galaga", Parent: "/media/fat/_Arcade/Galaga.mra", Clones: []string{}},
+		{ID: "puckman", Parent: "/media/fat/_Arcade/Pac-Man.mra", Clones: []string{
+			"/media/fat/_Arcade/Pac-Man (Midway).mra",
+			"/media/fat/_Arcade/_alternatives/_Pac-Man/Pac-Man (hack).mra",
+		}},
+	}
+	if !reflect.DeepEqual(families, want) {
+		t.Errorf("families = %+v\nwant %+v", families, want)
+	}
+	for i, clone := range []bool{true, false, true, true, false, false} {
+		if mras[i].Clone != clone {
+			t.Errorf("%s: clone = %v", mras[i].Path, mras[i].Clone)
+		}
+	}
+}
+
+func TestBuildRomZipReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romzips")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	arcade := pathlib.Join(dir, "_Arcade")
+	os.MkdirAll(pathlib.Join(arcade, "mame"), 0755)
+	used := pathlib.Join(arcade, "mame", "game.zip")
+	unused := pathlib.Join(arcade, "mame", "unused.zip")
+	ioutil.WriteFile(used, []byte("used"), 0644)
+	ioutil.WriteFile(unused, []byte("unused"), 0644)
+	ioutil.WriteFile(pathlib.Join(arcade, "mame", "notes.txt"), []byte("not a zip"), 0644)
+
+	mras := []MRA{
+		{Path: pathlib.Join(arcade, "Game.mra"), Zips: []string{used}, Audit: RomAudit{Status: AuditComplete}},
+		{Path: pathlib.Join(arcade, "Clone.mra"), Zips: []string{used}, Audit: RomAudit{Status: AuditIncomplete}},
+		{
+			Path:  pathlib.Join(arcade, "Lost.mra"),
+			Zips:  []string{},
+			Roms:  []MRARom{{Zip: "lost.zip|lostparent.zip", Index: "0"}, {Index: "1", Parts: []MRAPart{{Zip: "part.zip"}}}},
+			Audit: RomAudit{Status: AuditNoZip},
+		},
+	}
+	report := BuildRomZipReport(mras)
+
+	// The folders above the MRAs are listed too, only those of the test count
+	zips := make([]RomZip, 0)
+	for _, z := range report.Zips {
+		if strings.HasPrefix(z.Path, dir+"/") {
+			zips = append(zips, z)
+		}
+	}
+	wantZips := []RomZip{
+		{Path: used, Size: 4, MRAs: []string{mras[0].Path, mras[1].Path}},
+		{Path: unused, Size: 6, MRAs: []string{}},
+	}
+	if !reflect.DeepEqual(zips, wantZips) {
+		t.Errorf("zips = %+v, want %+v", zips, wantZips)
+	}
+	found := false
+	for _, z := range report.Unreferenced {
+		found = found || z == unused
+		if z == used {
+			t.Errorf("%s is unreferenced", used)
+		}
+	}
+	if !found {
+		t.Errorf("%s is not unreferenced: %v", unused, report.Unreferenced)
+	}
+	wantMissing := []MissingRomZips{{MRA: mras[2].Path, Zips: []string{"lost.zip", "lostparent.zip"}}}
+	if !reflect.DeepEqual(report.Missing, wantMissing) {
+		t.Errorf("missing = %+v, want %+v", report.Missing, wantMissing)
+	}
+}
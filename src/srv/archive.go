@@ -0,0 +1,220 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	pathlib "path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/sevenzip"
+)
+
+// isArchiveExt tells whether the game scan looks for ROMs inside files with
+// the given extension.
+func isArchiveExt(ext string) bool {
+	switch ext {
+	case "zip", "7z", "gz":
+		return true
+	}
+	return false
+}
+
+// filterMember checks an archive member against the databank from the size
+// and CRC32 stored in the archive, if any. When that is enough to tell
+// whether the member is known it is emitted, otherwise the member has to be
+// hashed and filterMember returns true.
+func (s *gameScan) filterMember(rom hashedROM, ext string, crc uint32, hasCRC bool) (bool, error) {
+	size := uint64(rom.size)
+	canHaveHeader := len(headerSizes(ext)) > 0
+	if hasCRC {
+		rom.hashes.CRC = fmt.Sprintf("%08x", crc)
+	}
+
+	// Check SIZE against bloom
+	if !maybeKnownSize(s.bank, ext, size) {
+		// Not a single known file matched size
+		s.emit(rom)
+		return false, nil
+	}
+	if !hasCRC {
+		return true, nil
+	}
+
+	// Check CRC32 against bloom. The CRC of a ROM with a header never
+	// matches, those have to be hashed.
+	crcMatched := s.bank.MaybeCRC(crc)
+	if !crcMatched && !canHaveHeader {
+		// Not a single known file matched crc
+		s.emit(rom)
+		return false, nil
+	}
+
+	// Identify from the archive when the CRC is not ambiguous. A single MD5
+	// is only enough when the index knows every file of its platform.
+	if crcMatched {
+		md5s, complete, err := s.bank.LookupCRC(crc, size)
+		if err != nil {
+			return false, err
+		}
+		if complete && len(md5s) == 0 && !canHaveHeader {
+			s.emit(rom)
+			return false, nil
+		}
+		if len(md5s) == 1 {
+			complete, err = s.bank.CompleteFor(md5s[0])
+			if err != nil {
+				return false, err
+			}
+			if complete {
+				rom.known = true
+				rom.hashes.Raw = md5s[0]
+				s.emit(rom)
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// hash7z hashes the ROMs inside a 7z archive. Solid archives are
+// decompressed once, skipping the members that don't need to be hashed.
+func (s *gameScan) hash7z(sf scanFile) error {
+	file, err := sevenzip.OpenReader(sf.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s.stats.current.Store(sf.path)
+	type member struct {
+		rom hashedROM
+		ext string
+	}
+	wanted := make(map[*sevenzip.File]member)
+	for _, zf := range file.File {
+		select {
+		case <-s.stop:
+			return errScanStopped
+		default:
+		}
+
+		ext := strings.TrimLeft(strings.ToLower(filepath.Ext(zf.Name)), ".")
+		if zf.IsDir || !IsKnownExt(ext) {
+			continue
+		}
+		rom := hashedROM{
+			file:   sf,
+			dir:    pathlib.Dir(sf.path[len(s.basePath):]),
+			name:   pathlib.Join(pathlib.Base(sf.path), zf.Name),
+			member: zf.Name,
+			size:   int64(zf.Size),
+			stored: int64(file.PackedSize(zf)),
+		}
+		if err := file.FolderError(zf); err != nil {
+			// Members compressed with other methods can't be hashed
+			rom.err = err.Error()
+			s.emit(rom)
+			continue
+		}
+		needed, err := s.filterMember(rom, ext, zf.CRC32, zf.HasCRC)
+		if err != nil {
+			return err
+		}
+		if needed {
+			wanted[zf] = member{rom, ext}
+		}
+	}
+
+	want := func(zf *sevenzip.File) bool {
+		_, ok := wanted[zf]
+		return ok
+	}
+	hashed := make(map[*sevenzip.File]bool)
+	err = file.Extract(want, func(zf *sevenzip.File, r io.Reader) error {
+		select {
+		case <-s.stop:
+			return errScanStopped
+		default:
+		}
+
+		m := wanted[zf]
+		hashes, err := s.hashReader(r, m.ext, zf.Size)
+		if err != nil {
+			return err
+		}
+		m.rom.hashes = hashes
+		m.rom.known = true
+		s.emit(m.rom)
+		hashed[zf] = true
+		return nil
+	})
+	if err == nil || err == errScanStopped {
+		return err
+	}
+	// As with zips, damaged members are reported one by one. The rest of a
+	// damaged solid block can't be read either.
+	for _, zf := range file.File {
+		if m, ok := wanted[zf]; ok && !hashed[zf] {
+			m.rom.err = err.Error()
+			s.emit(m.rom)
+		}
+	}
+	return nil
+}
+
+// hashGzip hashes a ROM compressed with gzip. The CRC32 and size of the
+// contents are at the end of the file, so the databank filters are checked
+// without decompressing it.
+func (s *gameScan) hashGzip(sf scanFile) error {
+	f, err := os.Open(sf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	name := pathlib.Base(strings.ReplaceAll(gz.Name, `\`, "/"))
+	if name == "" || name == "." || name == "/" {
+		name = strings.TrimSuffix(pathlib.Base(sf.path), filepath.Ext(sf.path))
+	}
+	ext := strings.TrimLeft(strings.ToLower(filepath.Ext(name)), ".")
+	if !IsKnownExt(ext) {
+		return nil
+	}
+
+	trailer := make([]byte, 8)
+	if _, err := f.ReadAt(trailer, sf.size-8); err != nil {
+		return err
+	}
+	s.stats.current.Store(sf.path)
+	rom := hashedROM{
+		file:   sf,
+		dir:    pathlib.Dir(sf.path[len(s.basePath):]),
+		name:   pathlib.Join(pathlib.Base(sf.path), name),
+		member: name,
+		// The size is stored modulo 2^32
+		size:   int64(binary.LittleEndian.Uint32(trailer[4:])),
+		stored: sf.size,
+	}
+	needed, err := s.filterMember(rom, ext, binary.LittleEndian.Uint32(trailer), true)
+	if err != nil || !needed {
+		return err
+	}
+
+	rom.hashes, err = s.hashReader(gz, ext, uint64(rom.size))
+	if err != nil {
+		return err
+	}
+	rom.known = true
+	s.emit(rom)
+	return nil
+}
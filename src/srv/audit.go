@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// AuditComplete means every part required by the MRA is in its zips.
+	AuditComplete = "complete"
+	// AuditIncomplete means some parts are missing or have a wrong CRC.
+	AuditIncomplete = "incomplete"
+	// AuditNoZip means none of the zips referenced by the MRA were found.
+	AuditNoZip = "no_zip"
+	// AuditBrokenZip means some of the zips could not be read.
+	AuditBrokenZip = "broken_zip"
+)
+
+// RomAudit is the result of comparing the parts an MRA needs with the
+// contents of its ROM zips.
+type RomAudit struct {
+	Status   string         `json:"status"`
+	Missing  []MRAPart      `json:"missing"`
+	WrongCRC []WrongCRCPart `json:"wrong_crc"`
+	Broken   []BrokenZip    `json:"broken"`
+}
+
+// BrokenZip is a ROM zip that could not be read.
+type BrokenZip struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// WrongCRCPart is a part present in the zip under the expected name but with
+// different contents.
+type WrongCRCPart struct {
+	MRAPart
+	Found string `json:"found"`
+}
+
+type zipEntries struct {
+	byName map[string]uint32
+	byCRC  map[uint32]bool
+}
+
+func parseCRC(s string) (uint32, bool) {
+	crc, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(strings.ToLower(s)), "0x"), 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(crc), true
+}
+
+// readZipEntries collects names and CRCs from the central directory of the
+// given zips. Nothing is decompressed. The zips that cannot be opened are
+// returned apart.
+func readZipEntries(zips []string) (zipEntries, []BrokenZip) {
+	entries := zipEntries{
+		byName: make(map[string]uint32),
+		byCRC:  make(map[uint32]bool),
+	}
+	broken := make([]BrokenZip, 0)
+	for _, z := range zips {
+		r, err := zip.OpenReader(z)
+		if err != nil {
+			broken = append(broken, BrokenZip{z, err.Error()})
+			continue
+		}
+		for _, f := range r.File {
+			name := strings.ToLower(f.Name)
+			if _, ok := entries.byName[name]; !ok {
+				entries.byName[name] = f.CRC32
+			}
+			entries.byCRC[f.CRC32] = true
+		}
+		r.Close()
+	}
+	return entries, broken
+}
+
+// auditMRA checks every part of the given roms against the zips found for
+// them. The roms of every index are audited, not only the game ROM of index
+// 0, and a part may name its own zips. Parts are matched by CRC first and by
+// name second, like the MiSTer main binary does. Parts with neither are
+// inline data. The status is, in this order:
+//
+//   - no_zip when there are roms but none of their zips was found
+//   - broken_zip when a zip could not be read
+//   - incomplete when a part is missing, or found by name with another CRC
+//   - complete otherwise
+//
+// It also returns every zip it read, those of the roms and those named by
+// single parts. RomsFound, set by resolveRomZips, also needs the zips of the
+// game ROM when the MRA has one.
+func auditMRA(roms []MRARom, baseDir string, zips []string) (RomAudit, []string) {
+	audit := RomAudit{
+		Status:   AuditComplete,
+		Missing:  make([]MRAPart, 0),
+		WrongCRC: make([]WrongCRCPart, 0),
+		Broken:   make([]BrokenZip, 0),
+	}
+
+	parts := make([]MRAPart, 0)
+	for _, rom := range roms {
+		parts = append(parts, rom.Parts...)
+		parts = append(parts, rom.Interleave...)
+	}
+	for _, part := range parts {
+		if part.Zip == "" {
+			continue
+		}
+		for _, z := range strings.Split(part.Zip, "|") {
+			if zipPath, ok := findRomZip(baseDir, z); ok {
+				zips = append(zips, zipPath)
+			}
+		}
+	}
+
+	zips = uniqueStrings(zips)
+	if len(roms) > 0 && len(zips) == 0 {
+		audit.Status = AuditNoZip
+		return audit, zips
+	}
+
+	entries, broken := readZipEntries(zips)
+	audit.Broken = broken
+	for _, part := range parts {
+		crc, hasCRC := parseCRC(part.CRC)
+		if part.Name == "" && !hasCRC {
+			// Inline data, nothing to look for
+			continue
+		}
+		if hasCRC && entries.byCRC[crc] {
+			continue
+		}
+		found, ok := entries.byName[strings.ToLower(part.Name)]
+		switch {
+		case !ok:
+			audit.Missing = append(audit.Missing, part)
+		case hasCRC && found != crc:
+			audit.WrongCRC = append(audit.WrongCRC, WrongCRCPart{part, fmt.Sprintf("%08x", found)})
+		}
+	}
+	if len(audit.Broken) > 0 {
+		audit.Status = AuditBrokenZip
+	} else if len(audit.Missing) > 0 || len(audit.WrongCRC) > 0 {
+		audit.Status = AuditIncomplete
+	}
+	return audit, zips
+}
+
+// uniqueStrings removes the repeated values of s, keeping the first ones.
+func uniqueStrings(s []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(s))
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	pathlib "path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRomZip creates a zip with the given files and contents.
+func writeRomZip(t *testing.T, p string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, contents := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(contents))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func crcOf(s string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(s)))
+}
+
+func TestAuditMRA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRomZip(t, pathlib.Join(dir, "game.zip"), map[string]string{"a.bin": "aaaa", "b.bin": "bbbb"})
+	writeRomZip(t, pathlib.Join(dir, "parent.zip"), map[string]string{"c.bin": "cccc"})
+	writeRomZip(t, pathlib.Join(dir, "hiscore.zip"), map[string]string{"h.bin": "hhhh"})
+	ioutil.WriteFile(pathlib.Join(dir, "broken.zip"), []byte("not a zip"), 0644)
+
+	tests := []struct {
+		name     string
+		roms     []MRARom
+		status   string
+		missing  int
+		wrongCRC int
+		zips     int
+	}{
+		{
+			"complete",
+			[]MRARom{{Zip: "game.zip|parent.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin", CRC: crcOf("aaaa")}, {Name: "c.bin", CRC: crcOf("cccc")}}}},
+			AuditComplete, 0, 0, 2,
+		},
+		{
+			"found by CRC under another name",
+			[]MRARom{{Zip: "game.zip", Index: "0", Parts: []MRAPart{{Name: "renamed.bin", CRC: "0x" + crcOf("bbbb")}}}},
+			AuditComplete, 0, 0, 1,
+		},
+		{
+			"found by name without a CRC",
+			[]MRARom{{Zip: "game.zip", Index: "0", Parts: []MRAPart{{Name: "A.BIN"}}}},
+			AuditComplete, 0, 0, 1,
+		},
+		{
+			"inline data",
+			[]MRARom{{Zip: "game.zip", Index: "0", Parts: []MRAPart{{}}}},
+			AuditComplete, 0, 0, 1,
+		},
+		{
+			"missing part",
+			[]MRARom{{Zip: "game.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin", CRC: crcOf("aaaa")}, {Name: "z.bin", CRC: "12345678"}}}},
+			AuditIncomplete, 1, 0, 1,
+		},
+		{
+			"wrong CRC",
+			[]MRARom{{Zip: "game.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin", CRC: "12345678"}}}},
+			AuditIncomplete, 0, 1, 1,
+		},
+		{
+			"rom other than the game ROM",
+			[]MRARom{
+				{Zip: "game.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin", CRC: crcOf("aaaa")}}},
+				{Zip: "hiscore.zip", Index: "1", Parts: []MRAPart{{Name: "missing.bin"}}},
+			},
+			AuditIncomplete, 1, 0, 2,
+		},
+		{
+			"zip named by a part",
+			[]MRARom{{Index: "0", Parts: []MRAPart{{Name: "h.bin", Zip: "hiscore.zip"}}, Interleave: []MRAPart{{Name: "c.bin", Zip: "parent.zip"}}}},
+			AuditComplete, 0, 0, 2,
+		},
+		{
+			"no zip",
+			[]MRARom{{Zip: "nothere.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin"}}}},
+			AuditNoZip, 0, 0, 0,
+		},
+		{
+			"broken zip",
+			[]MRARom{{Zip: "game.zip|broken.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin"}}}},
+			AuditBrokenZip, 0, 0, 2,
+		},
+		{
+			"broken zip and missing parts",
+			[]MRARom{{Zip: "broken.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin"}}}},
+			AuditBrokenZip, 1, 0, 1,
+		},
+		{"no roms", nil, AuditComplete, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		// The zips of the roms, as resolveRomZips finds them
+		zips := make([]string, 0)
+		for _, rom := range tt.roms {
+			for _, z := range strings.Split(rom.Zip, "|") {
+				if p, ok := findRomZip(dir, z); ok && z != "" {
+					zips = append(zips, p)
+				}
+			}
+		}
+		audit, read := auditMRA(tt.roms, dir, zips)
+		if audit.Status != tt.status || len(audit.Missing) != tt.missing || len(audit.WrongCRC) != tt.wrongCRC || len(read) != tt.zips {
+			t.Errorf("%s: audit = %+v, %d zips read, want %s, %d missing, %d wrong, %d zips",
+				tt.name, audit, len(read), tt.status, tt.missing, tt.wrongCRC, tt.zips)
+		}
+	}
+}
+
+func TestResolveRomZipsRomsFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRomZip(t, pathlib.Join(dir, "game.zip"), map[string]string{"a.bin": "aaaa"})
+	writeRomZip(t, pathlib.Join(dir, "hiscore.zip"), map[string]string{"h.bin": "hhhh"})
+
+	tests := []struct {
+		name  string
+		roms  []MRARom
+		found bool
+	}{
+		{"game ROM", []MRARom{{Zip: "game.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin"}}}}, true},
+		{"game ROM missing", []MRARom{
+			{Zip: "nothere.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin"}}},
+			{Zip: "hiscore.zip", Index: "1", Parts: []MRAPart{{Name: "h.bin"}}},
+		}, false},
+		{"only other roms", []MRARom{{Zip: "hiscore.zip", Index: "1", Parts: []MRAPart{{Name: "h.bin"}}}}, true},
+		{"incomplete other rom", []MRARom{
+			{Zip: "game.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin"}}},
+			{Zip: "hiscore.zip", Index: "1", Parts: []MRAPart{{Name: "x.bin"}}},
+		}, false},
+		{"no roms", nil, true},
+	}
+	for _, tt := range tests {
+		c := MRA{Path: pathlib.Join(dir, "game.mra"), Roms: tt.roms}
+		resolveRomZips(&c)
+		if c.RomsFound != tt.found {
+			t.Errorf("%s: roms found = %v, audit %+v", tt.name, c.RomsFound, c.Audit)
+		}
+	}
+}
+
+func TestResolveRomZipsReusesAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zipPath := pathlib.Join(dir, "game.zip")
+	writeRomZip(t, zipPath, map[string]string{"a.bin": "aaaa"})
+
+	c := MRA{Path: pathlib.Join(dir, "game.mra"), Roms: []MRARom{{Zip: "game.zip", Index: "0", Parts: []MRAPart{{Name: "a.bin"}}}}}
+	resolveRomZips(&c)
+	if c.Audit.Status != AuditComplete || c.ZipsStamp == "" {
+		t.Fatalf("audit = %+v, stamp %q", c.Audit, c.ZipsStamp)
+	}
+
+	// Same zips, the previous audit is kept without reading them
+	c.Audit.Status = "kept"
+	resolveRomZips(&c)
+	if c.Audit.Status != "kept" {
+		t.Errorf("unchanged zips audited again: %+v", c.Audit)
+	}
+
+	// A zip that changed is audited again
+	writeRomZip(t, zipPath, map[string]string{"b.bin": "bbbb"})
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(zipPath, later, later)
+	resolveRomZips(&c)
+	if c.Audit.Status != AuditIncomplete || c.RomsFound {
+		t.Errorf("changed zip: audit = %+v, roms found %v", c.Audit, c.RomsFound)
+	}
+
+	// And a zip found somewhere else
+	os.Remove(zipPath)
+	os.Mkdir(pathlib.Join(dir, "mame"), 0755)
+	writeRomZip(t, pathlib.Join(dir, "mame", "game.zip"), map[string]string{"a.bin": "aaaa"})
+	resolveRomZips(&c)
+	if c.Audit.Status != AuditComplete || !c.RomsFound {
+		t.Errorf("new zip: audit = %+v, roms found %v", c.Audit, c.RomsFound)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	pathlib "path"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
+)
+
+const (
+	// MatchSHA1 means the databank knows the CHD by the SHA1 of its data and
+	// metadata.
+	MatchSHA1 = "sha1"
+	// MatchRawSHA1 means the databank knows the CHD by the SHA1 of its data.
+	MatchRawSHA1 = "raw_sha1"
+)
+
+var chdTag = []byte("MComprHD")
+
+// CHDHeader holds the hashes stored in the header of a CHD file.
+type CHDHeader struct {
+	Version      uint32
+	LogicalBytes uint64
+	SHA1         string
+	RawSHA1      string
+}
+
+// readCHDHeader parses the header of a CHD file, versions 3 to 5. The hunks
+// are not read, the header already has the hashes of the whole image.
+func readCHDHeader(r io.Reader) (CHDHeader, error) {
+	var h CHDHeader
+
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return h, err
+	}
+	if !bytes.Equal(head[:8], chdTag) {
+		return h, errors.New("not a CHD file")
+	}
+	length := binary.BigEndian.Uint32(head[8:])
+	h.Version = binary.BigEndian.Uint32(head[12:])
+
+	var want uint32
+	switch h.Version {
+	case 3:
+		want = 120
+	case 4:
+		want = 108
+	case 5:
+		want = 124
+	default:
+		return h, fmt.Errorf("unsupported CHD version %d", h.Version)
+	}
+	if length != want {
+		return h, fmt.Errorf("invalid CHD v%d header length %d", h.Version, length)
+	}
+	buf := make([]byte, length)
+	copy(buf, head)
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return h, err
+	}
+
+	sha1 := func(offset int) string {
+		return fmt.Sprintf("%x", buf[offset:offset+20])
+	}
+	switch h.Version {
+	case 3:
+		h.LogicalBytes = binary.BigEndian.Uint64(buf[28:])
+		h.SHA1 = sha1(80)
+	case 4:
+		h.LogicalBytes = binary.BigEndian.Uint64(buf[28:])
+		h.SHA1 = sha1(48)
+		h.RawSHA1 = sha1(88)
+	case 5:
+		h.LogicalBytes = binary.BigEndian.Uint64(buf[32:])
+		h.RawSHA1 = sha1(64)
+		h.SHA1 = sha1(84)
+	}
+	return h, nil
+}
+
+// hashCHD takes the hashes of a CHD from its header.
+func (s *gameScan) hashCHD(sf scanFile) error {
+	s.stats.current.Store(sf.path)
+	rom := hashedROM{file: sf, dir: pathlib.Dir(sf.path[len(s.basePath):]), name: pathlib.Base(sf.path), size: sf.size, stored: sf.size}
+
+	f, err := os.Open(sf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header, err := readCHDHeader(f)
+	if err != nil {
+		return err
+	}
+	rom.size = int64(header.LogicalBytes)
+	rom.hashes = ROMHashes{SHA1: header.SHA1, RawSHA1: header.RawSHA1}
+	rom.known = true
+	s.emit(rom)
+	return nil
+}
+
+// identifyCHD looks a CHD up in the databank, by the SHA1 of the whole image
+// first. Only MAME DATs list these hashes, in their disk elements. Redump DATs
+// list the hashes of the tracks, which a CHD doesn't keep, so the CHDs of
+// their discs are not identified. The games of the MAME lists of Mega CD and
+// PC Engine CD discs get the Redump platforms and can be launched, the rest
+// are only identified.
+func identifyCHD(bank *databank.DataBank, hashes ROMHashes) (databank.Entry, string, error) {
+	entry, found, err := bank.LookupSHA1(hashes.SHA1)
+	if err != nil || found {
+		return entry, MatchSHA1, err
+	}
+	if hashes.RawSHA1 != "" {
+		entry, found, err = bank.LookupSHA1(hashes.RawSHA1)
+		if err != nil || found {
+			return entry, MatchRawSHA1, err
+		}
+	}
+	return entry, "", nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// chdV5Header is a v5 header laid out as chdman writes it for a CD image:
+// cdlz, cdzl and cdfl compressors, 1229 hunks of 8 frames of 2448 bytes and
+// no parent.
+const chdV5Header = "" +
+	"4d436f6d707248440000007c00000005" +
+	"63646c7a63647a6c6364666c00000000" +
+	"00000000016f42800000000003b3f1a2" +
+	"0000000003b3f0e000004c8000000990" +
+	"ce15802a8c5e8e9db0ffaf10130ef265" +
+	"296e9ea452e6d8ab88471af82da12a0e" +
+	"ae7aab01357e38810000000000000000" +
+	"000000000000000000000000"
+
+func TestReadCHDHeaderV5(t *testing.T) {
+	b, err := hex.DecodeString(chdV5Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The map follows the header, it must not be read
+	b = append(b, bytes.Repeat([]byte{0xff}, 64)...)
+
+	h, err := readCHDHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CHDHeader{
+		Version:      5,
+		LogicalBytes: 1229 * 19584,
+		SHA1:         "52e6d8ab88471af82da12a0eae7aab01357e3881",
+		RawSHA1:      "ce15802a8c5e8e9db0ffaf10130ef265296e9ea4",
+	}
+	if h != want {
+		t.Errorf("header = %+v, want %+v", h, want)
+	}
+}
+
+func TestReadCHDHeaderInvalid(t *testing.T) {
+	b, _ := hex.DecodeString(chdV5Header)
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"not a CHD", append([]byte("MComprHX"), b[8:]...), "not a CHD file"},
+		{"wrong length", append(append(append([]byte(nil), b[:8]...), 0, 0, 0, 0x78), b[12:]...), "invalid CHD v5 header length 120"},
+		{"version 2", append(append(append([]byte(nil), b[:12]...), 0, 0, 0, 2), b[16:]...), "unsupported CHD version 2"},
+		{"truncated", b[:100], "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		_, err := readCHDHeader(bytes.NewReader(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
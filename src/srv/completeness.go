@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	pathlib "path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
+)
+
+// Revision filters of the completeness report.
+const (
+	// Every revision of a title counts
+	RevisionAll = ""
+	// Only the last revision of each title counts
+	RevisionLatest = "latest"
+	// Only the first release of each title counts
+	RevisionOriginal = "original"
+)
+
+var (
+	nameTagRe  = regexp.MustCompile(`\(([^()]*)\)`)
+	revisionRe = regexp.MustCompile(`(?i)^(?:rev\s*([0-9a-z.]+)|v([0-9][0-9a-z.]*))$`)
+)
+
+// nameRevision splits a No-Intro name like "Game (USA) (Rev 1)" in the name
+// without the revision and the revision, "" for the first release.
+func nameRevision(name string) (base string, revision string) {
+	for _, m := range nameTagRe.FindAllStringSubmatchIndex(name, -1) {
+		r := revisionRe.FindStringSubmatch(name[m[2]:m[3]])
+		if r == nil {
+			continue
+		}
+		base = spacesRe.ReplaceAllString(name[:m[0]]+" "+name[m[1]:], " ")
+		return strings.TrimSpace(base), strings.ToLower(r[1] + r[2])
+	}
+	return name, ""
+}
+
+// compareRevisions compares the revisions returned by nameRevision, part by
+// part, numerically when both parts are numbers.
+func compareRevisions(a, b string) int {
+	if a == "" || b == "" {
+		return strings.Compare(a, b)
+	}
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		if errA == nil && errB == nil {
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		} else if c := strings.Compare(pa[i], pb[i]); c != 0 {
+			return c
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// nameRegions returns the regions, and languages, in the tags of a name.
+func nameRegions(name string) []string {
+	regions := make([]string, 0)
+	for _, m := range nameTagRe.FindAllStringSubmatch(name, -1) {
+		for _, r := range strings.Split(m[1], ",") {
+			regions = append(regions, strings.TrimSpace(r))
+		}
+	}
+	return regions
+}
+
+// CompletenessFilter narrows the titles of a platform taken into account.
+type CompletenessFilter struct {
+	// Titles of any of these regions, all when empty
+	Regions []string
+	// RevisionAll, RevisionLatest or RevisionOriginal
+	Revision string
+}
+
+func (f CompletenessFilter) region(name string) bool {
+	if len(f.Regions) == 0 {
+		return true
+	}
+	for _, r := range nameRegions(name) {
+		for _, want := range f.Regions {
+			if strings.EqualFold(r, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// titles returns the names that pass the filter.
+func (f CompletenessFilter) titles(names []string) []string {
+	latest := make(map[string]string)
+	result := make([]string, 0)
+	for _, name := range names {
+		if !f.region(name) {
+			continue
+		}
+		base, revision := nameRevision(name)
+		switch f.Revision {
+		case RevisionOriginal:
+			if revision == "" {
+				result = append(result, name)
+			}
+		case RevisionLatest:
+			if last, ok := latest[base]; !ok || compareRevisions(revision, last) > 0 {
+				latest[base] = revision
+			}
+		default:
+			result = append(result, name)
+		}
+	}
+	if f.Revision == RevisionLatest {
+		for _, name := range names {
+			if !f.region(name) {
+				continue
+			}
+			base, revision := nameRevision(name)
+			if latest[base] == revision {
+				result = append(result, name)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// CompletenessTitle is a title of the databank found by the game scans.
+type CompletenessTitle struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"`
+}
+
+// CompletenessReport tells which titles of a platform are in the library.
+type CompletenessReport struct {
+	Platform string              `json:"platform"`
+	Total    int                 `json:"total"`
+	Present  int                 `json:"present"`
+	Percent  float64             `json:"percent"`
+	Have     []CompletenessTitle `json:"have"`
+	Missing  []string            `json:"missing"`
+}
+
+// BuildCompletenessReport compares the titles the databank knows for a
+// platform with the games identified by the game scans.
+func BuildCompletenessReport(bank *databank.DataBank, platform string, filter CompletenessFilter) (CompletenessReport, error) {
+	report := CompletenessReport{
+		Platform: platform,
+		Have:     make([]CompletenessTitle, 0),
+		Missing:  make([]string, 0),
+	}
+
+	entries, err := bank.Entries(platform)
+	if err != nil {
+		return report, err
+	}
+	known := make(map[string]bool)
+	names := make([]string, 0)
+	for _, e := range entries {
+		if !known[e.Name] {
+			known[e.Name] = true
+			names = append(names, e.Name)
+		}
+	}
+
+	files := make(map[string][]string)
+	seen := make(map[string]bool)
+	err = forEachGameScan(func(header GameScanHeader, records []GameRecord) {
+		for _, r := range records {
+			if r.Platform != platform || r.Name == "" {
+				continue
+			}
+			p := pathlib.Join(header.Path, r.Dir, r.File)
+			if !seen[p] {
+				seen[p] = true
+				files[r.Name] = append(files[r.Name], p)
+			}
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, name := range filter.titles(names) {
+		if paths, ok := files[name]; ok {
+			sort.Strings(paths)
+			report.Have = append(report.Have, CompletenessTitle{Name: name, Files: paths})
+		} else {
+			report.Missing = append(report.Missing, name)
+		}
+	}
+	report.Present = len(report.Have)
+	report.Total = report.Present + len(report.Missing)
+	if report.Total > 0 {
+		report.Percent = float64(report.Present) * 100 / float64(report.Total)
+	}
+	return report, nil
+}
+
+func GetCompletenessReport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	platform := query.Get("platform")
+	if platform == "" {
+		http.Error(w, "missing platform", http.StatusBadRequest)
+		return
+	}
+	filter := CompletenessFilter{Regions: query["region"], Revision: query.Get("revision")}
+	switch filter.Revision {
+	case RevisionAll, RevisionLatest, RevisionOriginal:
+	default:
+		http.Error(w, fmt.Sprintf("unknown revision filter %q", filter.Revision), http.StatusBadRequest)
+		return
+	}
+
+	bank, err := databank.Open()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer bank.Close()
+
+	report, err := BuildCompletenessReport(bank, platform, filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNameRevision(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		revision string
+	}{
+		{"Game (USA)", "Game (USA)", ""},
+		{"Game (USA) (Rev 1)", "Game (USA)", "1"},
+		{"Game (USA) (Rev A)", "Game (USA)", "a"},
+		{"Game (Europe) (Rev 1.1) (Beta)", "Game (Europe) (Beta)", "1.1"},
+		{"Game (Japan) (v1.02)", "Game (Japan)", "1.02"},
+		{"Game (USA) (Virtual Console)", "Game (USA) (Virtual Console)", ""},
+		{"Revenge (USA)", "Revenge (USA)", ""},
+	}
+	for _, tt := range tests {
+		base, revision := nameRevision(tt.name)
+		if base != tt.base || revision != tt.revision {
+			t.Errorf("%s: %q %q, want %q %q", tt.name, base, revision, tt.base, tt.revision)
+		}
+	}
+}
+
+func TestCompareRevisions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		sign int
+	}{
+		{"", "", 0},
+		{"", "1", -1},
+		{"1", "", 1},
+		{"1", "2", -1},
+		{"2", "10", -1},
+		{"1.1", "1.02", -1},
+		{"1.1", "1.1.1", -1},
+		{"a", "b", -1},
+		{"b", "a", 1},
+		{"1.0", "1.0", 0},
+	}
+	for _, tt := range tests {
+		c := compareRevisions(tt.a, tt.b)
+		if (c < 0 && tt.sign >= 0) || (c > 0 && tt.sign <= 0) || (c == 0 && tt.sign != 0) {
+			t.Errorf("%q vs %q = %d, want sign %d", tt.a, tt.b, c, tt.sign)
+		}
+	}
+}
+
+func TestCompletenessFilterTitles(t *testing.T) {
+	names := []string{
+		"Game (USA)",
+		"Game (USA) (Rev 2)",
+		"Game (USA) (Rev 10)",
+		"Game (Europe)",
+		"Game (Japan, Korea) (Rev 1)",
+		"Other (Europe, Australia)",
+	}
+	tests := []struct {
+		filter CompletenessFilter
+		titles []string
+	}{
+		{CompletenessFilter{}, []string{"Game (Europe)", "Game (Japan, Korea) (Rev 1)", "Game (USA)", "Game (USA) (Rev 10)", "Game (USA) (Rev 2)", "Other (Europe, Australia)"}},
+		{CompletenessFilter{Revision: RevisionLatest}, []string{"Game (Europe)", "Game (Japan, Korea) (Rev 1)", "Game (USA) (Rev 10)", "Other (Europe, Australia)"}},
+		{CompletenessFilter{Revision: RevisionOriginal}, []string{"Game (Europe)", "Game (USA)", "Other (Europe, Australia)"}},
+		{CompletenessFilter{Regions: []string{"europe"}}, []string{"Game (Europe)", "Other (Europe, Australia)"}},
+		{CompletenessFilter{Regions: []string{"Korea", "USA"}, Revision: RevisionLatest}, []string{"Game (Japan, Korea) (Rev 1)", "Game (USA) (Rev 10)"}},
+	}
+	for _, tt := range tests {
+		if titles := tt.filter.titles(names); !reflect.DeepEqual(titles, tt.titles) {
+			t.Errorf("%+v: titles = %q, want %q", tt.filter, titles, tt.titles)
+		}
+	}
+}
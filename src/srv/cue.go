@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	pathlib "path"
+	"strings"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
+)
+
+// parseCue returns the files referenced by a CUE sheet, in order.
+func parseCue(r io.Reader) ([]string, error) {
+	files := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 5 || !strings.EqualFold(line[:5], "FILE ") {
+			continue
+		}
+		// FILE "name with spaces.bin" BINARY
+		rest := strings.TrimSpace(line[5:])
+		var name string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated file name: %s", line)
+			}
+			name = rest[1 : end+1]
+		} else if i := strings.LastIndex(rest, " "); i > 0 {
+			name = rest[:i]
+		} else {
+			name = rest
+		}
+		files = append(files, name)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no tracks in cue sheet")
+	}
+	return files, nil
+}
+
+// readCue returns the paths of the tracks of the CUE sheet at p.
+func readCue(p string) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files, err := parseCue(f)
+	if err != nil {
+		return nil, err
+	}
+	tracks := make([]string, len(files))
+	for i, name := range files {
+		tracks[i] = pathlib.Join(pathlib.Dir(p), strings.ReplaceAll(name, `\`, "/"))
+	}
+	return tracks, nil
+}
+
+// mayBeTrack tells whether files with the given extension can be tracks of
+// a CUE sheet. Those are only listed when no sheet refers to them.
+func mayBeTrack(ext string) bool {
+	return ext == "bin" || ext == "img"
+}
+
+// hashCue hashes every track of a CUE sheet. The whole disc becomes a
+// single ROM.
+func (s *gameScan) hashCue(sf scanFile) error {
+	s.stats.current.Store(sf.path)
+	rom := hashedROM{
+		file:   sf,
+		dir:    pathlib.Dir(sf.path[len(s.basePath):]),
+		name:   pathlib.Base(sf.path),
+		size:   sf.size,
+		stored: sf.size,
+		tracks: make([]ROMHashes, 0, len(sf.tracks)),
+	}
+
+	for _, track := range sf.tracks {
+		select {
+		case <-s.stop:
+			return errScanStopped
+		default:
+		}
+
+		f, err := os.Open(track)
+		if err != nil {
+			return err
+		}
+		if info, err := f.Stat(); err == nil {
+			rom.stored += info.Size()
+		}
+		hashes, err := s.hashReader(f, "bin", 0)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		rom.tracks = append(rom.tracks, hashes)
+	}
+	rom.hashes = rom.tracks[0]
+	rom.known = true
+	s.emit(rom)
+	return nil
+}
+
+// identifyDisc looks the tracks of a disc up in the databank. Redump lists
+// every track of a disc under the same game, all of them have to match it.
+func identifyDisc(bank *databank.DataBank, tracks []ROMHashes) (databank.Entry, string, error) {
+	var disc databank.Entry
+	for i, track := range tracks {
+		entry, found, err := bank.LookupMD5(track.Raw)
+		if err != nil || !found {
+			return disc, "", err
+		}
+		if i == 0 {
+			disc = entry
+		} else if entry.Platform != disc.Platform || entry.Name != disc.Name {
+			return disc, "", nil
+		}
+	}
+	return disc, MatchRaw, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	pathlib "path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCue(t *testing.T) {
+	tests := []struct {
+		name  string
+		cue   string
+		files []string
+		err   bool
+	}{
+		{
+			"quoted names",
+			"FILE \"Game (USA) (Track 01).bin\" BINARY\r\n  TRACK 01 MODE1/2352\r\n    INDEX 01 00:00:00\r\nFILE \"Game (USA) (Track 02).bin\" BINARY\r\n  TRACK 02 AUDIO\r\n",
+			[]string{"Game (USA) (Track 01).bin", "Game (USA) (Track 02).bin"},
+			false,
+		},
+		{"unquoted name", "FILE game.bin BINARY\nTRACK 01 MODE1/2352\n", []string{"game.bin"}, false},
+		{"unquoted name without type", "FILE game.bin\n", []string{"game.bin"}, false},
+		{"lower case and indented", "  file \"game.bin\" binary\n", []string{"game.bin"}, false},
+		{"subfolder", "FILE \"tracks\\game.bin\" BINARY\n", []string{"tracks\\game.bin"}, false},
+		{"unterminated name", "FILE \"game.bin BINARY\n", nil, true},
+		{"no tracks", "REM just a comment\nTRACK 01 AUDIO\n", nil, true},
+		{"empty", "", nil, true},
+	}
+	for _, tt := range tests {
+		files, err := parseCue(strings.NewReader(tt.cue))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+		if !tt.err && !reflect.DeepEqual(files, tt.files) {
+			t.Errorf("%s: files = %q, want %q", tt.name, files, tt.files)
+		}
+	}
+}
+
+func TestReadCue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := pathlib.Join(dir, "game.cue")
+	cue := "FILE \"game (Track 1).bin\" BINARY\nFILE \"tracks\\game (Track 2).bin\" BINARY\n"
+	if err := ioutil.WriteFile(p, []byte(cue), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := readCue(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{pathlib.Join(dir, "game (Track 1).bin"), pathlib.Join(dir, "tracks", "game (Track 2).bin")}
+	if !reflect.DeepEqual(tracks, want) {
+		t.Errorf("tracks = %q, want %q", tracks, want)
+	}
+}
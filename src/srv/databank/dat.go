@@ -0,0 +1,482 @@
+package databank
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	pathlib "path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+
+	"github.com/thetannerryan/ring"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	datsBucket   = "DATS"
+	sourceBucket = "SOURCE"
+	// False positive rate of the bloom filters built locally
+	bloomFalsePositive = 0.01
+)
+
+// DATsPath is where the imported DAT files are kept, to import them again
+// when the databank is updated.
+var DATsPath = pathlib.Join(system.CachePath, "dats")
+
+// DAT is a Logiqx XML DAT file imported into the databank.
+type DAT struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Version     string    `json:"version"`
+	File        string    `json:"file"`
+	Platform    string    `json:"platform"`
+	Imported    time.Time `json:"imported"`
+	// Hashes added to the databank
+	Entries int `json:"entries"`
+	// Hashes the databank already knew, they are left as they were
+	Known int `json:"known"`
+	// Files without a usable hash
+	Skipped int `json:"skipped"`
+}
+
+type datHeader struct {
+	Name        string `xml:"name"`
+	Description string `xml:"description"`
+	Version     string `xml:"version"`
+}
+
+type datROM struct {
+	Name string `xml:"name,attr"`
+	Size string `xml:"size,attr"`
+	CRC  string `xml:"crc,attr"`
+	MD5  string `xml:"md5,attr"`
+	SHA1 string `xml:"sha1,attr"`
+}
+
+type datGame struct {
+	Name  string   `xml:"name,attr"`
+	ROMs  []datROM `xml:"rom"`
+	Disks []datROM `xml:"disk"`
+}
+
+// datSuffixRe matches the tags No-Intro and Redump add to the names of their
+// DATs, like "(Headerless)" or "(20200101-000000)".
+var datSuffixRe = regexp.MustCompile(`(\s*\([^()]*\))+$`)
+
+// mameDiskPlatforms maps the names of the MAME software lists of CD systems
+// to the platforms of the Redump DATs, so the games of their CHDs have the
+// platform the web menu launches with the MegaCD and TurboGrafx16 cores. The
+// CHDs of other lists are identified but can't be launched.
+var mameDiskPlatforms = map[string]string{
+	"segacd":  "Sega - Mega CD & Sega CD",
+	"megacd":  "Sega - Mega CD & Sega CD",
+	"megacdj": "Sega - Mega CD & Sega CD",
+	"pcecd":   "NEC - PC Engine CD & TurboGrafx CD",
+}
+
+// datPlatform is the platform of the games of a DAT, the name of the DAT
+// without its tags.
+func datPlatform(name string) string {
+	platform := strings.TrimSpace(datSuffixRe.ReplaceAllString(name, ""))
+	if p, ok := mameDiskPlatforms[strings.ToLower(platform)]; ok {
+		return p
+	}
+	return platform
+}
+
+// readDAT reads the header and the games of a Logiqx XML DAT. MAME style
+// machine elements are read as games too. header is called before the first
+// game, with an empty header when the DAT has none.
+func readDAT(r io.Reader, header func(datHeader) error, game func(datGame) error) error {
+	var h datHeader
+	headerDone := false
+	doHeader := func() error {
+		if headerDone {
+			return nil
+		}
+		headerDone = true
+		return header(h)
+	}
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		// Names are ASCII in practice, whatever the declaration says
+		return input, nil
+	}
+	datafile := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "datafile", "mame":
+			datafile = true
+		case "header":
+			if err := dec.DecodeElement(&h, &start); err != nil {
+				return err
+			}
+			if err := doHeader(); err != nil {
+				return err
+			}
+		case "game", "machine":
+			var g datGame
+			if err := dec.DecodeElement(&g, &start); err != nil {
+				return err
+			}
+			if err := doHeader(); err != nil {
+				return err
+			}
+			if err := game(g); err != nil {
+				return err
+			}
+		}
+	}
+	if !datafile {
+		return errors.New("not a Logiqx XML DAT file")
+	}
+	return doHeader()
+}
+
+// hexHash normalizes a hash of n bytes, it returns "" when it is not one.
+func hexHash(s string, n int) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if b, err := hex.DecodeString(s); err != nil || len(b) != n {
+		return ""
+	}
+	return s
+}
+
+// ImportDAT adds the games of the Logiqx XML DAT at p to the databank,
+// creating it when there is none, and rebuilds the bloom filters. The games
+// go to the given platform, or to the one named by the DAT when empty.
+// Importing a DAT again replaces the entries it added before. Hashes the
+// databank already knows, from the download or from another DAT, are not
+// changed, removing the DAT must not lose them. Files are added by MD5, disks
+// by SHA1: CHD images are only identified by MAME DATs, the
+// Redump ones list the tracks of the discs. The CRC32 and size of the files
+// go to the CRC index, the platform is marked as complete when the index then
+// knows all of its files.
+func ImportDAT(p string, platform string) (DAT, error) {
+	dat := DAT{File: p, Imported: time.Now()}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return dat, err
+	}
+	defer f.Close()
+
+	indexed, err := indexedMD5s()
+	if err != nil {
+		return dat, err
+	}
+
+	os.MkdirAll(pathlib.Dir(Path), 0755)
+	db, err := bolt.Open(Path, 0600, &bolt.Options{Timeout: time.Minute})
+	if err != nil {
+		return dat, err
+	}
+	defer db.Close()
+
+	var learnt []CRCEntry
+	err = db.Update(func(tx *bolt.Tx) error {
+		fresh := tx.Bucket([]byte(md5Bucket)) == nil
+		buckets := make(map[string]*bolt.Bucket)
+		for _, name := range []string{md5Bucket, sha1Bucket, sourceBucket, datsBucket, bloomBucket} {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			buckets[name] = b
+		}
+		// The CRC bucket of the databank must know every file, it is only
+		// built when there was no databank at all. Otherwise the CRCs of
+		// the DAT go to the learnt index.
+		complete := fresh || tx.Bucket([]byte(crcBucket)) != nil
+
+		var crcValues []uint32
+		var sizeValues []uint64
+		add := func(rom datROM, md5 string) {
+			crc, err := strconv.ParseUint(rom.CRC, 16, 32)
+			if err != nil {
+				return
+			}
+			size, err := strconv.ParseUint(rom.Size, 10, 64)
+			if err != nil {
+				return
+			}
+			crcValues = append(crcValues, uint32(crc))
+			sizeValues = append(sizeValues, size)
+			learnt = append(learnt, CRCEntry{uint32(crc), size, md5})
+		}
+
+		var name string
+		err = readDAT(f, func(h datHeader) error {
+			name = h.Name
+			if name == "" {
+				name = pathlib.Base(p)
+			}
+			if platform == "" {
+				platform = datPlatform(h.Name)
+			}
+			if platform == "" {
+				return errors.New("the DAT does not name its platform")
+			}
+			dat.Description = h.Description
+			dat.Version = h.Version
+			return removeDAT(tx, name)
+		}, func(g datGame) error {
+			value := []byte(platform + ";" + g.Name)
+			put := func(bucket, prefix, hash string) error {
+				b := buckets[bucket]
+				if b.Get([]byte(hash)) != nil {
+					// Unless the DAT lists the file twice
+					if string(buckets[sourceBucket].Get([]byte(prefix+hash))) != name {
+						dat.Known++
+					}
+					return nil
+				}
+				if err := b.Put([]byte(hash), value); err != nil {
+					return err
+				}
+				dat.Entries++
+				return buckets[sourceBucket].Put([]byte(prefix+hash), []byte(name))
+			}
+			for _, rom := range g.ROMs {
+				md5 := hexHash(rom.MD5, 16)
+				if md5 == "" {
+					dat.Skipped++
+					continue
+				}
+				if err := put(md5Bucket, "md5:", md5); err != nil {
+					return err
+				}
+				// The CRC of a known file still leads to its MD5
+				add(rom, md5)
+			}
+			for _, disk := range g.Disks {
+				sha1 := hexHash(disk.SHA1, 20)
+				if sha1 == "" {
+					dat.Skipped++
+					continue
+				}
+				if err := put(sha1Bucket, "sha1:", sha1); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		dat.Name = name
+		dat.Platform = platform
+
+		if complete {
+			if err := addCRCs(tx, learnt); err != nil {
+				return err
+			}
+			learnt = nil
+		} else {
+			for _, e := range learnt {
+				indexed[e.MD5] = true
+			}
+			if err := markComplete(tx, platform, indexed); err != nil {
+				return err
+			}
+		}
+
+		if err := rebuildBloom(tx, crcValues, sizeValues); err != nil {
+			return err
+		}
+		record, err := json.Marshal(dat)
+		if err != nil {
+			return err
+		}
+		return buckets[datsBucket].Put([]byte(dat.Name), record)
+	})
+	if err != nil {
+		return dat, err
+	}
+	return dat, LearnCRCs(learnt)
+}
+
+// removeDAT deletes the entries added by a previous import of the same DAT,
+// and their MD5s from the CRC index of the databank so the bloom filters
+// built from it forget them too. The learnt CRC index keeps them, LookupCRC
+// only returns MD5s the databank still knows.
+func removeDAT(tx *bolt.Tx, name string) error {
+	sources := tx.Bucket([]byte(sourceBucket))
+	var keys [][]byte
+	err := sources.ForEach(func(k, v []byte) error {
+		if string(v) == name {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	removed := make(map[string]bool)
+	for _, k := range keys {
+		parts := strings.SplitN(string(k), ":", 2)
+		bucket := md5Bucket
+		if parts[0] == "sha1" {
+			bucket = sha1Bucket
+		} else {
+			removed[parts[1]] = true
+		}
+		if err := tx.Bucket([]byte(bucket)).Delete([]byte(parts[1])); err != nil {
+			return err
+		}
+		if err := sources.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	crcs := tx.Bucket([]byte(crcBucket))
+	if crcs == nil || len(removed) == 0 {
+		return nil
+	}
+	updates := make(map[string][]string)
+	err = crcs.ForEach(func(k, v []byte) error {
+		md5s := strings.Split(string(v), ",")
+		left := make([]string, 0, len(md5s))
+		for _, md5 := range md5s {
+			if !removed[md5] {
+				left = append(left, md5)
+			}
+		}
+		if len(left) != len(md5s) {
+			updates[string(k)] = left
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, md5s := range updates {
+		if len(md5s) == 0 {
+			err = crcs.Delete([]byte(k))
+		} else {
+			err = crcs.Put([]byte(k), []byte(strings.Join(md5s, ",")))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildBloom updates the bloom filters with the CRCs and sizes of the
+// imported files. With a CRC index the filters are built again from it, sized
+// for the whole databank, otherwise the values are added to the downloaded
+// ones.
+func rebuildBloom(tx *bolt.Tx, crcValues []uint32, sizeValues []uint64) error {
+	bloom := tx.Bucket([]byte(bloomBucket))
+	crcBuf := make([]byte, 4)
+	sizeBuf := make([]byte, 8)
+
+	var crcRing, sizeRing *ring.Ring
+	if crcs := tx.Bucket([]byte(crcBucket)); crcs != nil {
+		crcValues = crcValues[:0]
+		sizeValues = sizeValues[:0]
+		err := crcs.ForEach(func(k, v []byte) error {
+			crcValues = append(crcValues, binary.BigEndian.Uint32(k))
+			sizeValues = append(sizeValues, binary.BigEndian.Uint64(k[4:]))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		n := len(crcValues)
+		if n == 0 {
+			n = 1
+		}
+		if crcRing, err = ring.Init(n, bloomFalsePositive); err != nil {
+			return err
+		}
+		if sizeRing, err = ring.Init(n, bloomFalsePositive); err != nil {
+			return err
+		}
+	} else {
+		crcRing, sizeRing = new(ring.Ring), new(ring.Ring)
+		v := bloom.Get([]byte(crcKey))
+		if v == nil {
+			return errors.New("CRC bloom filter is missing")
+		}
+		if err := crcRing.UnmarshalBinary(v); err != nil {
+			return err
+		}
+		v = bloom.Get([]byte(sizeKey))
+		if v == nil {
+			return errors.New("Size bloom filter is missing")
+		}
+		if err := sizeRing.UnmarshalBinary(v); err != nil {
+			return err
+		}
+	}
+
+	for _, crc := range crcValues {
+		binary.LittleEndian.PutUint32(crcBuf, crc)
+		crcRing.Add(crcBuf)
+	}
+	for _, size := range sizeValues {
+		binary.LittleEndian.PutUint64(sizeBuf, size)
+		sizeRing.Add(sizeBuf)
+	}
+
+	for key, r := range map[string]*ring.Ring{crcKey: crcRing, sizeKey: sizeRing} {
+		v, err := r.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := bloom.Put([]byte(key), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportedDATs returns the DATs imported into the databank.
+func ImportedDATs() ([]DAT, error) {
+	dats := make([]DAT, 0)
+	if _, err := os.Stat(Path); os.IsNotExist(err) {
+		return dats, nil
+	}
+	db, err := bolt.Open(Path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Minute})
+	if err != nil {
+		return dats, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(datsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var dat DAT
+			if err := json.Unmarshal(v, &dat); err != nil {
+				return fmt.Errorf("invalid DAT record %s: %v", k, err)
+			}
+			dats = append(dats, dat)
+			return nil
+		})
+	})
+	return dats, err
+}
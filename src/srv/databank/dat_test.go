@@ -0,0 +1,246 @@
+package databank
+
+import (
+	"io/ioutil"
+	"os"
+	pathlib "path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/thetannerryan/ring"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestReadDAT(t *testing.T) {
+	tests := []struct {
+		name   string
+		dat    string
+		header datHeader
+		games  []datGame
+		err    bool
+	}{
+		{
+			"logiqx",
+			`<?xml version="1.0"?>
+<datafile>
+	<header><name>Nintendo - NES (Headerless)</name><description>NES</description><version>20200101</version></header>
+	<game name="Game (USA)"><rom name="Game (USA).nes" size="40960" crc="0123abcd" md5="00112233445566778899aabbccddeeff"/></game>
+</datafile>`,
+			datHeader{"Nintendo - NES (Headerless)", "NES", "20200101"},
+			[]datGame{{Name: "Game (USA)", ROMs: []datROM{{"Game (USA).nes", "40960", "0123abcd", "00112233445566778899aabbccddeeff", ""}}}},
+			false,
+		},
+		{
+			"mame machines and disks",
+			`<mame><machine name="cdgame"><disk name="cdgame" sha1="0123456789abcdef0123456789abcdef01234567"/></machine></mame>`,
+			datHeader{},
+			[]datGame{{Name: "cdgame", Disks: []datROM{{Name: "cdgame", SHA1: "0123456789abcdef0123456789abcdef01234567"}}}},
+			false,
+		},
+		{
+			"no games",
+			`<datafile><header><name>Empty</name></header></datafile>`,
+			datHeader{Name: "Empty"},
+			nil,
+			false,
+		},
+		{"not a DAT", `<html><body>Not found</body></html>`, datHeader{}, nil, true},
+		{"truncated", `<datafile><game name="a"><rom`, datHeader{}, nil, true},
+	}
+	for _, tt := range tests {
+		headers := 0
+		var header datHeader
+		var games []datGame
+		err := readDAT(strings.NewReader(tt.dat), func(h datHeader) error {
+			headers++
+			header = h
+			return nil
+		}, func(g datGame) error {
+			if headers != 1 {
+				t.Errorf("%s: game read before the header", tt.name)
+			}
+			games = append(games, g)
+			return nil
+		})
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+		if tt.err {
+			continue
+		}
+		if headers != 1 || header != tt.header {
+			t.Errorf("%s: header = %+v (%d times), want %+v", tt.name, header, headers, tt.header)
+		}
+		if !reflect.DeepEqual(games, tt.games) {
+			t.Errorf("%s: games = %+v, want %+v", tt.name, games, tt.games)
+		}
+	}
+}
+
+func TestDATPlatform(t *testing.T) {
+	tests := map[string]string{
+		"Nintendo - Nintendo Entertainment System (Headerless) (20200101-000000)": "Nintendo - Nintendo Entertainment System",
+		"Sega - Mega-CD - Sega CD": "Sega - Mega-CD - Sega CD",
+		"segacd":                   "Sega - Mega CD & Sega CD",
+		"megacdj (20210101)":       "Sega - Mega CD & Sega CD",
+		"pcecd":                    "NEC - PC Engine CD & TurboGrafx CD",
+		"":                         "",
+	}
+	for name, want := range tests {
+		if p := datPlatform(name); p != want {
+			t.Errorf("%q: platform = %q, want %q", name, p, want)
+		}
+	}
+}
+
+// withDownloadedDatabank points the databank to a temporary one that knows
+// the given MD5s, like the downloaded databank it has no CRC index.
+func withDownloadedDatabank(t *testing.T, md5s map[string]string) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "databank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldIndex := Path, CRCIndexPath
+	Path = pathlib.Join(dir, "databank.db")
+	CRCIndexPath = pathlib.Join(dir, "crcindex.db")
+	cleanup := func() {
+		Path, CRCIndexPath = oldPath, oldIndex
+		os.RemoveAll(dir)
+	}
+
+	db, err := bolt.Open(Path, 0600, nil)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(md5Bucket))
+		if err != nil {
+			return err
+		}
+		for md5, v := range md5s {
+			if err := b.Put([]byte(md5), []byte(v)); err != nil {
+				return err
+			}
+		}
+		bloom, err := tx.CreateBucket([]byte(bloomBucket))
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{crcKey, sizeKey} {
+			r, err := ring.Init(10, bloomFalsePositive)
+			if err != nil {
+				return err
+			}
+			v, err := r.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := bloom.Put([]byte(key), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return cleanup
+}
+
+func writeDAT(t *testing.T, dir string, name string, games ...string) string {
+	t.Helper()
+	p := pathlib.Join(dir, "test.dat")
+	dat := `<datafile><header><name>` + name + `</name></header>` + strings.Join(games, "") + `</datafile>`
+	if err := ioutil.WriteFile(p, []byte(dat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestImportDATKeepsKnownEntries(t *testing.T) {
+	const (
+		known = "00112233445566778899aabbccddeeff"
+		added = "ffeeddccbbaa99887766554433221100"
+	)
+	defer withDownloadedDatabank(t, map[string]string{known: "NES;Downloaded (USA)"})()
+
+	p := writeDAT(t, pathlib.Dir(Path), "Nintendo - NES",
+		`<game name="Renamed (USA)"><rom name="a.nes" size="16" crc="00000001" md5="`+known+`"/></game>`,
+		`<game name="New (USA)"><rom name="b.nes" size="16" crc="00000002" md5="`+added+`"/></game>`,
+		`<game name="New (USA) (Alt)"><rom name="b.nes" size="16" crc="00000002" md5="`+added+`"/></game>`,
+	)
+	dat, err := ImportDAT(p, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dat.Entries != 1 || dat.Known != 1 || dat.Platform != "Nintendo - NES" {
+		t.Errorf("dat = %+v", dat)
+	}
+
+	// Importing it again without the new game removes only that one
+	p = writeDAT(t, pathlib.Dir(Path), "Nintendo - NES",
+		`<game name="Renamed (USA)"><rom name="a.nes" size="16" crc="00000001" md5="`+known+`"/></game>`,
+	)
+	if _, err := ImportDAT(p, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	e, found, err := d.LookupMD5(known)
+	if err != nil || !found || e.Name != "Downloaded (USA)" || e.Source != "" {
+		t.Errorf("downloaded entry = %+v, %v, %v", e, found, err)
+	}
+	if _, found, err := d.LookupMD5(added); err != nil || found {
+		t.Errorf("entry of the removed game found = %v, %v", found, err)
+	}
+}
+
+func TestImportDATMarksCompletePlatforms(t *testing.T) {
+	const (
+		downloaded = "00112233445566778899aabbccddeeff"
+		withCRC    = "ffeeddccbbaa99887766554433221100"
+		withoutCRC = "0123456789abcdef0123456789abcdef"
+	)
+	defer withDownloadedDatabank(t, map[string]string{downloaded: "Sega - Mega Drive;Game (Europe)"})()
+
+	p := writeDAT(t, pathlib.Dir(Path), "Nintendo - NES",
+		`<game name="A (USA)"><rom name="a.nes" size="16" crc="00000001" md5="`+withCRC+`"/></game>`,
+	)
+	if _, err := ImportDAT(p, ""); err != nil {
+		t.Fatal(err)
+	}
+	p = writeDAT(t, pathlib.Dir(Path), "Nintendo - SNES",
+		`<game name="B (USA)"><rom name="b.sfc" size="16" md5="`+withoutCRC+`"/></game>`,
+	)
+	if _, err := ImportDAT(p, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := LearnCRCs([]CRCEntry{{1, 16, downloaded}}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	md5s, _, err := d.LookupCRC(1, 16)
+	if err != nil || !reflect.DeepEqual(md5s, []string{withCRC, downloaded}) {
+		t.Errorf("LookupCRC = %v, %v", md5s, err)
+	}
+	for md5, want := range map[string]bool{withCRC: true, withoutCRC: false, downloaded: false} {
+		if complete, err := d.CompleteFor(md5); err != nil || complete != want {
+			t.Errorf("%s: complete = %v, %v, want %v", md5, complete, err, want)
+		}
+	}
+}
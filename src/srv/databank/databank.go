@@ -0,0 +1,408 @@
+package databank
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	pathlib "path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+
+	"github.com/thetannerryan/ring"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	bloomBucket = "BLOOM"
+	md5Bucket   = "MD5"
+	crcBucket   = "CRC"
+	sha1Bucket  = "SHA1"
+	// Platforms whose every file is in the learnt CRC index
+	completeBucket = "COMPLETE"
+	crcKey         = "crc"
+	sizeKey        = "size"
+)
+
+// Path is the location of the game databank.
+var Path = pathlib.Join(system.CachePath, "databank.db")
+
+// CRCIndexPath is the location of the CRC32 and size index learnt from the
+// files identified by the scans and from imported DATs. The downloaded
+// databank only knows MD5s, this index is kept apart so it survives updates
+// and learning doesn't change the databank.
+var CRCIndexPath = pathlib.Join(system.CachePath, "crcindex.db")
+
+// DataBank gives access to the known games, indexed by MD5 and by CRC32 and
+// size. The CRC bucket of the databank is complete when present, it is only
+// built when the whole databank comes from imported DATs. The learnt index
+// only knows some of the games, the platforms it knows completely are kept in
+// the COMPLETE bucket of the databank.
+type DataBank struct {
+	db       *bolt.DB
+	learnt   *bolt.DB
+	crcRing  *ring.Ring
+	sizeRing *ring.Ring
+	crcIndex bool
+}
+
+// Entry is a known game. Only the hash it was found by is set.
+type Entry struct {
+	Platform string
+	Name     string
+	MD5      string
+	SHA1     string
+	// Name of the imported DAT the entry comes from, empty for the entries
+	// of the downloaded databank
+	Source string
+}
+
+// Open opens the databank read-only and loads its bloom filters.
+func Open() (*DataBank, error) {
+	db, err := bolt.Open(Path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Minute})
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DataBank{
+		db:       db,
+		crcRing:  new(ring.Ring),
+		sizeRing: new(ring.Ring),
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bloomBucket))
+		if b == nil {
+			return errors.New("Bloom filters are missing")
+		}
+		v := b.Get([]byte(crcKey))
+		if v == nil {
+			return errors.New("CRC bloom filter is missing")
+		}
+		d.crcRing.UnmarshalBinary(v)
+
+		v = b.Get([]byte(sizeKey))
+		if v == nil {
+			return errors.New("Size bloom filter is missing")
+		}
+		d.sizeRing.UnmarshalBinary(v)
+
+		d.crcIndex = tx.Bucket([]byte(crcBucket)) != nil
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if !d.crcIndex {
+		if _, err := os.Stat(CRCIndexPath); err == nil {
+			d.learnt, err = bolt.Open(CRCIndexPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Minute})
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+func (d *DataBank) Close() error {
+	if d.learnt != nil {
+		d.learnt.Close()
+	}
+	return d.db.Close()
+}
+
+// MaybeSize tells whether any known game could have the given size.
+func (d *DataBank) MaybeSize(size uint64) bool {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, size)
+	return d.sizeRing.Test(buf)
+}
+
+// MaybeCRC tells whether any known game could have the given CRC32.
+func (d *DataBank) MaybeCRC(crc uint32) bool {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, crc)
+	return d.crcRing.Test(buf)
+}
+
+// LookupMD5 returns the game with the given MD5, in hexadecimal.
+func (d *DataBank) LookupMD5(md5 string) (Entry, bool, error) {
+	var e Entry
+	var found bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(md5Bucket)).Get([]byte(md5))
+		if v != nil {
+			var err error
+			e, err = parseEntry(md5, v)
+			e.MD5 = md5
+			e.Source = source(tx, "md5:"+md5)
+			found = err == nil
+			return err
+		}
+		return nil
+	})
+	return e, found, err
+}
+
+// LookupSHA1 returns the game with the given SHA1, in hexadecimal. Only the
+// disk elements of imported MAME DATs add SHA1 hashes, the downloaded
+// databank has none.
+func (d *DataBank) LookupSHA1(sha1 string) (Entry, bool, error) {
+	var e Entry
+	var found bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sha1Bucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(sha1))
+		if v != nil {
+			var err error
+			e, err = parseEntry(sha1, v)
+			e.SHA1 = sha1
+			e.Source = source(tx, "sha1:"+sha1)
+			found = err == nil
+			return err
+		}
+		return nil
+	})
+	return e, found, err
+}
+
+// Entries returns the games of a platform, once for each hash they are known
+// by. Games made of several files, like the tracks of a disc, show up once
+// per file.
+func (d *DataBank) Entries(platform string) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	prefix := []byte(platform + ";")
+	err := d.db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{md5Bucket, sha1Bucket} {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				continue
+			}
+			err := b.ForEach(func(k, v []byte) error {
+				if !bytes.HasPrefix(v, prefix) {
+					return nil
+				}
+				e, err := parseEntry(string(k), v)
+				if err != nil {
+					return err
+				}
+				if bucket == md5Bucket {
+					e.MD5 = string(k)
+				} else {
+					e.SHA1 = string(k)
+				}
+				entries = append(entries, e)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func source(tx *bolt.Tx, key string) string {
+	b := tx.Bucket([]byte(sourceBucket))
+	if b == nil {
+		return ""
+	}
+	return string(b.Get([]byte(key)))
+}
+
+func parseEntry(key string, v []byte) (Entry, error) {
+	values := strings.SplitN(string(v), ";", 2)
+	if len(values) != 2 {
+		return Entry{}, errors.New("Invalid databank entry for " + key)
+	}
+	return Entry{Platform: values[0], Name: values[1]}, nil
+}
+
+// CRCKey is the key of a file in the CRC bucket.
+func CRCKey(crc uint32, size uint64) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint32(key, crc)
+	binary.BigEndian.PutUint64(key[4:], size)
+	return key
+}
+
+// LookupCRC returns the MD5 of the known games with the given CRC32 and size.
+// More than one MD5 means a collision, and the file must be hashed to tell
+// them apart. complete is false when the index doesn't know every game, then
+// finding no MD5 doesn't mean the file is unknown.
+func (d *DataBank) LookupCRC(crc uint32, size uint64) (md5s []string, complete bool, err error) {
+	index := d.db
+	if !d.crcIndex {
+		index = d.learnt
+	}
+	if index == nil {
+		return nil, false, nil
+	}
+	err = index.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(crcBucket))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(CRCKey(crc, size)); v != nil {
+			md5s = strings.Split(string(v), ",")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The index may have MD5s the databank no longer knows
+	known := md5s[:0]
+	err = d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(md5Bucket))
+		for _, md5 := range md5s {
+			if b.Get([]byte(md5)) != nil {
+				known = append(known, md5)
+			}
+		}
+		return nil
+	})
+	return known, d.crcIndex, err
+}
+
+// CompleteFor tells whether the CRC index knows every file of the platform of
+// the game with the given MD5. Only then a single MD5 found by LookupCRC
+// identifies a file, otherwise another file of the platform could have the
+// same CRC32 and size.
+func (d *DataBank) CompleteFor(md5 string) (bool, error) {
+	if d.crcIndex {
+		return true, nil
+	}
+	complete := false
+	err := d.db.View(func(tx *bolt.Tx) error {
+		platforms := tx.Bucket([]byte(completeBucket))
+		if platforms == nil {
+			return nil
+		}
+		v := tx.Bucket([]byte(md5Bucket)).Get([]byte(md5))
+		if v == nil {
+			return nil
+		}
+		e, err := parseEntry(md5, v)
+		if err != nil {
+			return err
+		}
+		complete = platforms.Get([]byte(e.Platform)) != nil
+		return nil
+	})
+	return complete, err
+}
+
+// indexedMD5s returns the MD5s known by the learnt CRC index.
+func indexedMD5s() (map[string]bool, error) {
+	md5s := make(map[string]bool)
+	if _, err := os.Stat(CRCIndexPath); os.IsNotExist(err) {
+		return md5s, nil
+	}
+	db, err := bolt.Open(CRCIndexPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Minute})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(crcBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			for _, md5 := range strings.Split(string(v), ",") {
+				md5s[md5] = true
+			}
+			return nil
+		})
+	})
+	return md5s, err
+}
+
+// markComplete records in tx whether every file of the platform has its MD5
+// in indexed.
+func markComplete(tx *bolt.Tx, platform string, indexed map[string]bool) error {
+	platforms, err := tx.CreateBucketIfNotExists([]byte(completeBucket))
+	if err != nil {
+		return err
+	}
+	prefix := []byte(platform + ";")
+	files := 0
+	complete := true
+	err = tx.Bucket([]byte(md5Bucket)).ForEach(func(k, v []byte) error {
+		if bytes.HasPrefix(v, prefix) {
+			files++
+			complete = complete && indexed[string(k)]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !complete || files == 0 {
+		return platforms.Delete([]byte(platform))
+	}
+	return platforms.Put([]byte(platform), []byte(strconv.Itoa(files)))
+}
+
+// CRCEntry tells the CRC32 and size of a file with a known MD5.
+type CRCEntry struct {
+	CRC  uint32
+	Size uint64
+	MD5  string
+}
+
+// addCRCs adds entries to the CRC bucket of tx.
+func addCRCs(tx *bolt.Tx, entries []CRCEntry) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(crcBucket))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		key := CRCKey(e.CRC, e.Size)
+		md5s := make([]string, 0)
+		if v := b.Get(key); v != nil {
+			md5s = strings.Split(string(v), ",")
+		}
+		found := false
+		for _, m := range md5s {
+			found = found || m == e.MD5
+		}
+		if !found {
+			if err := b.Put(key, []byte(strings.Join(append(md5s, e.MD5), ","))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LearnCRCs adds the CRC32 and size of files identified by their MD5 to the
+// learnt CRC index, so the same files are identified from the headers of
+// archives next time.
+func LearnCRCs(entries []CRCEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	os.MkdirAll(pathlib.Dir(CRCIndexPath), 0755)
+	db, err := bolt.Open(CRCIndexPath, 0600, &bolt.Options{Timeout: time.Minute})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return addCRCs(tx, entries)
+	})
+}
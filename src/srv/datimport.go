@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	pathlib "path"
+	"strings"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
+	"github.com/nilp0inter/MiSTer_WebMenu/jobs"
+)
+
+// saveDAT copies a DAT to databank.DATsPath, where it is kept to import it
+// again after databank updates.
+func saveDAT(name string, r io.Reader) (string, error) {
+	name = pathlib.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" {
+		name = "unnamed.dat"
+	}
+	if err := os.MkdirAll(databank.DATsPath, 0755); err != nil {
+		return "", err
+	}
+	dst := pathlib.Join(databank.DATsPath, name)
+
+	f, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return dst, os.Rename(f.Name(), dst)
+}
+
+// ImportDAT imports a Logiqx XML DAT into the databank. The DAT is uploaded
+// as the dat field of a form, or found on the SD card at path. platform
+// overrides the platform named by the DAT.
+func ImportDAT(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var src io.ReadCloser
+	var name string
+	if upload, header, err := r.FormFile("dat"); err == nil {
+		src, name = upload, header.Filename
+	} else if p := r.FormValue("path"); p != "" {
+		f, err := os.Open(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		src, name = f, pathlib.Base(p)
+	} else {
+		http.Error(w, "missing dat or path", http.StatusBadRequest)
+		return
+	}
+	dst, err := saveDAT(name, src)
+	src.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Importing waits for the scans, they have the databank open
+	platform := r.FormValue("platform")
+	job := scanJobs.Start("dat", dst, func(job *jobs.Job) (interface{}, error) {
+		return databank.ImportDAT(dst, platform)
+	})
+	waitForJob(w, r, job)
+}
+
+// ListDATs returns the DATs imported into the databank.
+func ListDATs(w http.ResponseWriter, r *http.Request) {
+	dats, err := databank.ImportedDATs()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dats)
+}
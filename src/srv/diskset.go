@@ -0,0 +1,120 @@
+package main
+
+import (
+	pathlib "path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DiskSet tells which set of disks of a game a record belongs to.
+type DiskSet struct {
+	Title string `json:"title"`
+	Disk  int    `json:"disk"`
+	// Files of the set in loading order, the first one boots the game.
+	// Archive members are given by the archive and member path, like File.
+	Files []string `json:"files"`
+}
+
+// diskTagRe matches the disk tags of No-Intro and TOSEC names, like
+// "(Disk 1 of 3)", "(Disc 2)", "(Disk 1 Side B)" or "(Side A)".
+var diskTagRe = regexp.MustCompile(`(?i)\s*\((?:(?:disk|disc)\s*([0-9]+|[a-z])(?:\s*of\s*[0-9]+)?(?:\s*side\s*([a-z]))?|side\s*([a-z]))\)`)
+
+var spacesRe = regexp.MustCompile(`\s+`)
+
+// diskTag returns the title of a disk, without its tag and extension, and
+// its position in the set. ok is false when the name has no disk tag.
+func diskTag(name string) (title string, order int, ok bool) {
+	name = strings.TrimSuffix(name, pathlib.Ext(name))
+	m := diskTagRe.FindStringSubmatchIndex(name)
+	if m == nil {
+		return "", 0, false
+	}
+	group := func(i int) string {
+		if m[2*i] < 0 {
+			return ""
+		}
+		return strings.ToLower(name[m[2*i]:m[2*i+1]])
+	}
+	letter := func(s string) int {
+		return int(s[0]-'a') + 1
+	}
+
+	disk, side := 0, 0
+	if d := group(1); d != "" {
+		if n, err := strconv.Atoi(d); err == nil {
+			disk = n
+		} else {
+			disk = letter(d)
+		}
+	}
+	if s := group(2); s != "" {
+		side = letter(s)
+	} else if s := group(3); s != "" {
+		side = letter(s)
+	}
+	title = spacesRe.ReplaceAllString(name[:m[0]]+" "+name[m[1]:], " ")
+	return strings.TrimSpace(title), disk*100 + side, true
+}
+
+// groupDiskSets finds the records that are disks of the same game, in the
+// same folder, and gives them their DiskSet. Identified disks are grouped by
+// the name of the databank entry, the others by their file name.
+func groupDiskSets(records []GameRecord) {
+	type disk struct {
+		record int
+		order  int
+	}
+	sets := make(map[string][]disk)
+	titles := make(map[string]string)
+	for i, r := range records {
+		records[i].DiskSet = nil
+		if r.Error != "" {
+			continue
+		}
+		name := pathlib.Base(r.File)
+		folder := pathlib.Dir(r.File)
+		if r.Member != "" {
+			// Sets are often made of one archive per disk, their members
+			// are grouped by the folder of the archives. Members without a
+			// disk tag take the one of their archive.
+			archive := strings.TrimSuffix(r.File, "/"+r.Member)
+			folder = pathlib.Dir(archive)
+			if _, _, ok := diskTag(name); !ok {
+				name = strings.TrimSuffix(pathlib.Base(archive), pathlib.Ext(archive)) + pathlib.Ext(r.File)
+			}
+		}
+		if r.Name != "" {
+			name = r.Name + pathlib.Ext(r.File)
+		}
+		title, order, ok := diskTag(name)
+		if !ok {
+			continue
+		}
+		key := strings.Join([]string{r.Dir, folder, strings.ToLower(pathlib.Ext(r.File)), strings.ToLower(title)}, "\x00")
+		sets[key] = append(sets[key], disk{i, order})
+		if _, ok := titles[key]; !ok || r.Name != "" {
+			titles[key] = title
+		}
+	}
+
+	for key, disks := range sets {
+		if len(disks) < 2 {
+			continue
+		}
+		sort.SliceStable(disks, func(i, j int) bool {
+			if disks[i].order != disks[j].order {
+				return disks[i].order < disks[j].order
+			}
+			return records[disks[i].record].File < records[disks[j].record].File
+		})
+		files := make([]string, len(disks))
+		for i, d := range disks {
+			files[i] = records[d.record].File
+		}
+		for i, d := range disks {
+			records[d.record].DiskSet = &DiskSet{Title: titles[key], Disk: i + 1, Files: files}
+		}
+	}
+}
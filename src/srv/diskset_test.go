@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiskTag(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		order int
+		ok    bool
+	}{
+		{"Game (Europe) (Disk 1 of 3).adf", "Game (Europe)", 100, true},
+		{"Game (Europe) (Disk 3 of 3).adf", "Game (Europe)", 300, true},
+		{"Game (Disk 10 of 12).adf", "Game", 1000, true},
+		{"Game (USA) (Disc 2).cue", "Game (USA)", 200, true},
+		{"Game (disc 3).CUE", "Game", 300, true},
+		{"Game (Disk B).d64", "Game", 200, true},
+		{"Game (Disk 2 Side B).d64", "Game", 202, true},
+		{"Game (Side A).d64", "Game", 1, true},
+		{"Game (Disk 1 of 2) (Save).adf", "Game (Save)", 100, true},
+		{"Game (USA).nes", "", 0, false},
+		{"Diskworld (USA).adf", "", 0, false},
+		{"Game (Diskette).adf", "", 0, false},
+	}
+	for _, tt := range tests {
+		title, order, ok := diskTag(tt.name)
+		if title != tt.title || order != tt.order || ok != tt.ok {
+			t.Errorf("%s: %q %d %v, want %q %d %v", tt.name, title, order, ok, tt.title, tt.order, tt.ok)
+		}
+	}
+}
+
+func TestGroupDiskSets(t *testing.T) {
+	records := []GameRecord{
+		{Dir: "/media/fat/games", File: "Amiga/Game (Disk 2 of 2).adf"},
+		{Dir: "/media/fat/games", File: "Amiga/Game (Disk 1 of 2).adf"},
+		{Dir: "/media/fat/games", File: "Amiga/Other (Disk 1 of 2).adf"},
+		{Dir: "/media/fat/games", File: "Amiga/Copy/Game (Disk 1 of 2).adf"},
+		{Dir: "/media/fat/games", File: "Amiga/Game (USA).adf"},
+		// Archives of one disk each, the member takes the tag of its archive
+		{Dir: "/media/fat/games", File: "C64/Game (Disk 1).zip/game.d64", Member: "game.d64"},
+		{Dir: "/media/fat/games", File: "C64/Game (Disk 2).zip/game.d64", Member: "game.d64"},
+		{Dir: "/media/fat/games", File: "C64/Broken (Disk 1).d64", Error: "unreadable"},
+		{Dir: "/media/fat/games", File: "C64/Broken (Disk 2).d64"},
+	}
+	groupDiskSets(records)
+
+	amiga := []string{"Amiga/Game (Disk 1 of 2).adf", "Amiga/Game (Disk 2 of 2).adf"}
+	c64 := []string{"C64/Game (Disk 1).zip/game.d64", "C64/Game (Disk 2).zip/game.d64"}
+	want := []*DiskSet{
+		{Title: "Game", Disk: 2, Files: amiga},
+		{Title: "Game", Disk: 1, Files: amiga},
+		nil,
+		nil,
+		nil,
+		{Title: "Game", Disk: 1, Files: c64},
+		{Title: "Game", Disk: 2, Files: c64},
+		nil,
+		nil,
+	}
+	for i, r := range records {
+		if !reflect.DeepEqual(r.DiskSet, want[i]) {
+			t.Errorf("%s: disk set = %+v, want %+v", r.File, r.DiskSet, want[i])
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	pathlib "path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+)
+
+// forEachGameScan calls fn with every game scan in the games database.
+// Broken scans are skipped, scanning their folder again fixes them.
+func forEachGameScan(fn func(GameScanHeader, []GameRecord)) error {
+	return filepath.Walk(system.GamesDBPath, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(p, ".jsonl") {
+			return nil
+		}
+		header, records, err := ReadGameScan(p)
+		if err != nil {
+			log.Println(p, err)
+			return nil
+		}
+		if header.Path == "" {
+			header.Path = strings.TrimSuffix(p[len(system.GamesDBPath):], ".jsonl")
+		}
+		fn(header, records)
+		return nil
+	})
+}
+
+// DuplicateFile is a copy of a game found by a game scan.
+type DuplicateFile struct {
+	Path string `json:"path"`
+	// Uncompressed size, members of archives take less on disk
+	Size int64 `json:"size"`
+	// Bytes taken on disk, the compressed size for members of archives
+	Stored int64 `json:"stored"`
+	// Inside a zip, 7z or gzip archive
+	Archived bool `json:"archived"`
+	// Inside an archive with other files. Removing it means rewriting the
+	// archive, so it doesn't count as reclaimable space.
+	Shared bool `json:"shared"`
+}
+
+// freed is the space deleting the copy gives back.
+func (f DuplicateFile) freed() int64 {
+	if f.Shared {
+		return 0
+	}
+	return f.Stored
+}
+
+// DuplicateGroup is a set of files with the same contents.
+type DuplicateGroup struct {
+	Hash     string          `json:"hash"`
+	Name     string          `json:"name"`
+	Platform string          `json:"platform"`
+	Files    []DuplicateFile `json:"files"`
+	// Some copies are archived and some are not
+	Mixed bool `json:"zipped_and_unzipped"`
+	// Space freed keeping only the copy that takes the least to delete,
+	// copies in archives with other files are kept first
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+// DuplicateReport lists the games found more than once by the game scans.
+type DuplicateReport struct {
+	Groups []DuplicateGroup `json:"groups"`
+	// Reclaimable space per platform, unidentified files are under ""
+	Reclaimable      map[string]int64 `json:"reclaimable"`
+	ReclaimableTotal int64            `json:"reclaimable_total"`
+}
+
+// duplicateKey is the hash the files are joined by: the MD5 of the databank
+// entry for identified games, the hash of the contents for the rest. Discs
+// without a match are left out, their records only hash the first track.
+func duplicateKey(r GameRecord) string {
+	switch {
+	case r.Error != "":
+		return ""
+	case r.MD5 != "":
+		return "md5:" + r.MD5
+	case r.Tracks != nil:
+		return ""
+	case r.RawMD5 != "":
+		return "md5:" + r.RawMD5
+	case r.SHA1 != "":
+		return "sha1:" + r.SHA1
+	}
+	return ""
+}
+
+// BuildDuplicateReport joins the records of every game scan by hash. A file
+// found by several scans, of nested folders, is only counted once.
+func BuildDuplicateReport() (DuplicateReport, error) {
+	report := DuplicateReport{
+		Groups:      make([]DuplicateGroup, 0),
+		Reclaimable: make(map[string]int64),
+	}
+
+	groups := make(map[string]*DuplicateGroup)
+	seen := make(map[string]bool)
+	err := forEachGameScan(func(header GameScanHeader, records []GameRecord) {
+		members := make(map[string]int)
+		for _, r := range records {
+			if r.Member != "" {
+				members[archivePath(r)]++
+			}
+		}
+		for _, r := range records {
+			key := duplicateKey(r)
+			if key == "" {
+				continue
+			}
+			file := DuplicateFile{
+				Path:     pathlib.Join(header.Path, r.Dir, r.File),
+				Size:     r.Size,
+				Stored:   r.Stored,
+				Archived: r.Member != "",
+				Shared:   r.Member != "" && members[archivePath(r)] > 1,
+			}
+			if file.Stored == 0 {
+				// Scans older than version 6 only have the uncompressed size
+				file.Stored = file.Size
+			}
+			if seen[file.Path] {
+				continue
+			}
+			seen[file.Path] = true
+
+			g, ok := groups[key]
+			if !ok {
+				g = &DuplicateGroup{Hash: key[strings.Index(key, ":")+1:]}
+				groups[key] = g
+			}
+			if g.Name == "" {
+				g.Name = r.Name
+				g.Platform = r.Platform
+			}
+			g.Files = append(g.Files, file)
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, g := range groups {
+		if len(g.Files) < 2 {
+			continue
+		}
+		sort.Slice(g.Files, func(i, j int) bool { return g.Files[i].Path < g.Files[j].Path })
+		var total int64
+		kept := g.Files[0].freed()
+		archived := 0
+		for _, f := range g.Files {
+			total += f.freed()
+			if f.freed() < kept {
+				kept = f.freed()
+			}
+			if f.Archived {
+				archived++
+			}
+		}
+		g.Mixed = archived > 0 && archived < len(g.Files)
+		g.Reclaimable = total - kept
+		report.Reclaimable[g.Platform] += g.Reclaimable
+		report.ReclaimableTotal += g.Reclaimable
+		report.Groups = append(report.Groups, *g)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		a, b := report.Groups[i], report.Groups[j]
+		if a.Platform != b.Platform {
+			return a.Platform < b.Platform
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Files[0].Path < b.Files[0].Path
+	})
+
+	return report, nil
+}
+
+// archivePath is the path of the archive a member record is in, relative
+// to the scanned folder.
+func archivePath(r GameRecord) string {
+	return pathlib.Join(r.Dir, strings.TrimSuffix(r.File, "/"+r.Member))
+}
+
+// WriteCSV writes the report as one row per duplicated file.
+func (report DuplicateReport) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"platform", "name", "hash", "path", "size", "stored", "archived", "shared"})
+	for _, g := range report.Groups {
+		for _, f := range g.Files {
+			out.Write([]string{g.Platform, g.Name, g.Hash, f.Path, strconv.FormatInt(f.Size, 10), strconv.FormatInt(f.Stored, 10), strconv.FormatBool(f.Archived), strconv.FormatBool(f.Shared)})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func GetDuplicateReport(w http.ResponseWriter, r *http.Request) {
+	report, err := BuildDuplicateReport()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	format, ok := r.URL.Query()["format"]
+	if ok && format[0] == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"duplicates.csv\"")
+		report.WriteCSV(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"duplicates.json\"")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	pathlib "path"
+	"reflect"
+	"testing"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+)
+
+func TestDuplicateKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		record GameRecord
+		key    string
+	}{
+		{"identified", GameRecord{MD5: "aa", RawMD5: "bb"}, "md5:aa"},
+		{"unidentified", GameRecord{RawMD5: "bb"}, "md5:bb"},
+		{"CHD", GameRecord{SHA1: "cc"}, "sha1:cc"},
+		{"identified disc", GameRecord{MD5: "aa", RawMD5: "bb", Tracks: []string{"t1.bin"}}, "md5:aa"},
+		{"unidentified disc", GameRecord{RawMD5: "bb", Tracks: []string{"t1.bin"}}, ""},
+		{"error", GameRecord{RawMD5: "bb", Error: "unreadable"}, ""},
+		{"no hash", GameRecord{}, ""},
+	}
+	for _, tt := range tests {
+		if key := duplicateKey(tt.record); key != tt.key {
+			t.Errorf("%s: key = %q, want %q", tt.name, key, tt.key)
+		}
+	}
+}
+
+func TestBuildDuplicateReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "games")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath := system.GamesDBPath
+	system.GamesDBPath = dir
+	defer func() { system.GamesDBPath = oldPath }()
+
+	write := func(scanPath string, records []GameRecord) {
+		p := gameScanPath(scanPath)
+		os.MkdirAll(pathlib.Dir(p), 0755)
+		if err := WriteGameScan(p, newGameScanHeader(scanPath), records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("/media/fat/games", []GameRecord{
+		{Dir: "/NES", File: "Game.nes", Size: 40976, Stored: 40976, MD5: "aa", Name: "Game", Platform: "NES"},
+		{Dir: "/NES", File: "Game.zip/game.nes", Member: "game.nes", Size: 40976, Stored: 20000, MD5: "aa", Name: "Game", Platform: "NES"},
+		{Dir: "/NES", File: "Pack.zip/game.nes", Member: "game.nes", Size: 40976, Stored: 20000, MD5: "aa", Name: "Game", Platform: "NES"},
+		{Dir: "/NES", File: "Pack.zip/other.nes", Member: "other.nes", Size: 40976, Stored: 20000, MD5: "bb", Name: "Other", Platform: "NES"},
+		{Dir: "/NES", File: "x.nes", Size: 100, RawMD5: "cc"},
+		{Dir: "/NES", File: "y.nes", Size: 100, RawMD5: "cc"},
+		{Dir: "/NES", File: "broken.nes", RawMD5: "cc", Error: "unreadable"},
+	})
+	// A scan of a nested folder finds the same file again
+	write("/media/fat/games/NES", []GameRecord{
+		{Dir: "/", File: "Game.nes", Size: 40976, Stored: 40976, MD5: "aa", Name: "Game", Platform: "NES"},
+	})
+
+	report, err := BuildDuplicateReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DuplicateReport{
+		Groups: []DuplicateGroup{
+			{
+				Hash: "cc",
+				Files: []DuplicateFile{
+					{Path: "/media/fat/games/NES/x.nes", Size: 100, Stored: 100},
+					{Path: "/media/fat/games/NES/y.nes", Size: 100, Stored: 100},
+				},
+				Reclaimable: 100,
+			},
+			{
+				Hash:     "aa",
+				Name:     "Game",
+				Platform: "NES",
+				Files: []DuplicateFile{
+					{Path: "/media/fat/games/NES/Game.nes", Size: 40976, Stored: 40976},
+					{Path: "/media/fat/games/NES/Game.zip/game.nes", Size: 40976, Stored: 20000, Archived: true},
+					{Path: "/media/fat/games/NES/Pack.zip/game.nes", Size: 40976, Stored: 20000, Archived: true, Shared: true},
+				},
+				Mixed: true,
+				// The copy shared with other.nes is the one kept
+				Reclaimable: 60976,
+			},
+		},
+		Reclaimable:      map[string]int64{"": 100, "NES": 60976},
+		ReclaimableTotal: 61076,
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report = %+v\nwant %+v", report, want)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	pathlib "path"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+)
+
+// Fingerprint identifies the contents of a scanned file, along with the
+// records the scan produced for it.
+type Fingerprint struct {
+	Size    int64        `json:"size"`
+	Mtime   int64        `json:"mtime"`
+	Records []GameRecord `json:"records"`
+}
+
+// FingerprintIndex holds the fingerprints of every file of a game scan, so
+// a rescan only hashes new or modified files.
+type FingerprintIndex struct {
+	// GameScanVersion of the records
+	Version int `json:"version"`
+	// Modification time of the databank used to identify the files
+	DataBank int64                   `json:"databank"`
+	Files    map[string]*Fingerprint `json:"files"`
+}
+
+func NewFingerprintIndex() *FingerprintIndex {
+	return &FingerprintIndex{Version: GameScanVersion, Files: make(map[string]*Fingerprint)}
+}
+
+// Add appends records to the fingerprint of the file.
+func (idx *FingerprintIndex) Add(sf scanFile, records ...GameRecord) {
+	fp, ok := idx.Files[sf.path]
+	if !ok {
+		fp = &Fingerprint{Size: sf.size, Mtime: sf.mtime, Records: make([]GameRecord, 0)}
+		idx.Files[sf.path] = fp
+	}
+	fp.Records = append(fp.Records, records...)
+}
+
+func fingerprintIndexPath(scanPath string) string {
+	return pathlib.Join(system.FingerprintsPath, scanPath+".json")
+}
+
+// LoadFingerprintIndex reads the index of the last scan of scanPath.
+func LoadFingerprintIndex(scanPath string) (*FingerprintIndex, error) {
+	b, err := ioutil.ReadFile(fingerprintIndexPath(scanPath))
+	if err != nil {
+		return nil, err
+	}
+	idx := NewFingerprintIndex()
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// SaveFingerprintIndex writes the index of a scan of scanPath.
+func SaveFingerprintIndex(scanPath string, idx *FingerprintIndex) error {
+	p := fingerprintIndexPath(scanPath)
+	if err := os.MkdirAll(pathlib.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, b, 0644)
+}
+
+// RemoveFingerprintIndex deletes the index of scanPath, if any.
+func RemoveFingerprintIndex(scanPath string) error {
+	err := os.Remove(fingerprintIndexPath(scanPath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
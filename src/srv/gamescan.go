@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	pathlib "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+)
+
+// GameScanVersion is the version of the game scan format. It must be
+// increased whenever GameRecord changes. Scans written before the format had
+// a header are version 1.
+const GameScanVersion = 6
+
+// GameScanHeader is the first line of a game scan.
+type GameScanHeader struct {
+	Version int       `json:"version"`
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+}
+
+// GameRecord is a line of a game scan. It describes a file, or a member of
+// an archive, and the game it was identified as, if any.
+type GameRecord struct {
+	Dir  string `json:"dir"`
+	File string `json:"file"`
+	// Path inside the archive, for archive members
+	Member string `json:"member,omitempty"`
+	// Track files of a CUE sheet, relative to it
+	Tracks []string `json:"tracks,omitempty"`
+	// Uncompressed size of the contents
+	Size int64 `json:"size"`
+	// Bytes taken on disk: the compressed size of archive members, the
+	// tracks too for CUE sheets. Unknown in scans before version 6.
+	Stored int64 `json:"stored,omitempty"`
+	// Modification time of the file on disk
+	Mtime int64  `json:"mtime"`
+	CRC   string `json:"crc,omitempty"`
+	// Size of the header stripped to get the headerless MD5
+	Header int `json:"header,omitempty"`
+	// Set of disks of the game the file is part of
+	DiskSet *DiskSet `json:"disk_set,omitempty"`
+
+	Name     string `json:"name"`
+	Platform string `json:"platform"`
+	// MD5 that identified the game
+	MD5           string `json:"md5"`
+	RawMD5        string `json:"raw_md5,omitempty"`
+	HeaderlessMD5 string `json:"headerless_md5,omitempty"`
+	SHA1          string `json:"sha1,omitempty"`
+	RawSHA1       string `json:"raw_sha1,omitempty"`
+	// Which of the hashes matched, MatchRaw, MatchHeaderless, MatchSHA1 or
+	// MatchRawSHA1
+	Matched string `json:"matched,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// UnmarshalJSON also reads the records of version 1 scans, which were
+// arrays of dir, file, name, platform, MD5 and, in later releases, raw MD5,
+// headerless MD5, match and error.
+func (g *GameRecord) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		var fields [9]string
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return err
+		}
+		*g = GameRecord{
+			Dir:           fields[0],
+			File:          fields[1],
+			Name:          fields[2],
+			Platform:      fields[3],
+			MD5:           fields[4],
+			RawMD5:        fields[5],
+			HeaderlessMD5: fields[6],
+			Matched:       fields[7],
+			Error:         fields[8],
+		}
+		return nil
+	}
+	type plain GameRecord
+	return json.Unmarshal(b, (*plain)(g))
+}
+
+// record returns the record of the file. Tracks are relative to the folder of
+// the sheet, those it can't be relative to make the record an error.
+func (h hashedROM) record() GameRecord {
+	var tracks []string
+	var trackErr error
+	for _, track := range h.file.tracks {
+		rel, err := filepath.Rel(pathlib.Dir(h.file.path), track)
+		if err != nil {
+			trackErr = err
+			continue
+		}
+		tracks = append(tracks, filepath.ToSlash(rel))
+	}
+	record := GameRecord{
+		Dir:           h.dir,
+		File:          h.name,
+		Member:        h.member,
+		Tracks:        tracks,
+		Size:          h.size,
+		Stored:        h.stored,
+		Mtime:         h.file.mtime,
+		CRC:           h.hashes.CRC,
+		Header:        h.hashes.Header,
+		RawMD5:        h.hashes.Raw,
+		HeaderlessMD5: h.hashes.Headerless,
+		SHA1:          h.hashes.SHA1,
+		RawSHA1:       h.hashes.RawSHA1,
+	}
+	if trackErr != nil {
+		record.Error = trackErr.Error()
+	}
+	return record
+}
+
+func newGameRecord(rom hashedROM, entry databank.Entry, matched string) GameRecord {
+	record := rom.record()
+	if matched != "" {
+		record.Name = entry.Name
+		record.Platform = entry.Platform
+		record.MD5 = entry.MD5
+		record.Matched = matched
+	}
+	return record
+}
+
+func newGameError(rom hashedROM) GameRecord {
+	record := rom.record()
+	if rom.err != "" {
+		record.Error = rom.err
+	}
+	return record
+}
+
+func newGameScanHeader(scanPath string) GameScanHeader {
+	return GameScanHeader{Version: GameScanVersion, Path: scanPath, Created: time.Now()}
+}
+
+func gameScanPath(scanPath string) string {
+	return pathlib.Join(system.GamesDBPath, scanPath+".jsonl")
+}
+
+// ReadGameScan reads the game scan at p. Records of older versions are
+// converted to the current GameRecord, the header keeps the version of the
+// file.
+func ReadGameScan(p string) (GameScanHeader, []GameRecord, error) {
+	var header GameScanHeader
+	records := make([]GameRecord, 0)
+
+	f, err := os.Open(p)
+	if err != nil {
+		return header, records, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for first := true; ; first = false {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if first && !bytes.HasPrefix(bytes.TrimSpace(line), []byte("[")) {
+				if err := json.Unmarshal(line, &header); err != nil {
+					return header, records, err
+				}
+			} else {
+				var record GameRecord
+				if err := json.Unmarshal(line, &record); err != nil {
+					return header, records, err
+				}
+				records = append(records, record)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return header, records, err
+		}
+	}
+	if header.Version == 0 {
+		header.Version = 1
+	}
+	return header, records, nil
+}
+
+// WriteGameScan replaces the game scan at p.
+func WriteGameScan(p string, header GameScanHeader, records []GameRecord) error {
+	f, err := os.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&header); err != nil {
+		return err
+	}
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// ConvertGameScans rewrites the game scans written by older versions in the
+// current format, so the web client only has to understand that one.
+func ConvertGameScans() error {
+	return filepath.Walk(system.GamesDBPath, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(p, ".jsonl") {
+			return nil
+		}
+		header, records, err := ReadGameScan(p)
+		if err != nil {
+			// A broken scan is left alone, scanning again fixes it
+			log.Println(p, err)
+			return nil
+		}
+		if header.Version >= GameScanVersion {
+			return nil
+		}
+		log.Printf("Converting %s from version %d\n", p, header.Version)
+		header.Version = GameScanVersion
+		header.Path = strings.TrimSuffix(p[len(system.GamesDBPath):], ".jsonl")
+		if header.Created.IsZero() {
+			header.Created = info.ModTime()
+		}
+		return WriteGameScan(p, header, records)
+	})
+}
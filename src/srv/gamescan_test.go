@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	pathlib "path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalGameRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		json   string
+		record GameRecord
+		err    bool
+	}{
+		{
+			"version 1, first releases",
+			`["/media/fat/games","NES/Game.nes","Game (USA)","Nintendo - Nintendo Entertainment System","0123"]`,
+			GameRecord{Dir: "/media/fat/games", File: "NES/Game.nes", Name: "Game (USA)", Platform: "Nintendo - Nintendo Entertainment System", MD5: "0123"},
+			false,
+		},
+		{
+			"version 1, matched headerless",
+			`["/media/fat/games","NES/Game.nes","Game (USA)","NES","0123","4567","0123","headerless",""]`,
+			GameRecord{Dir: "/media/fat/games", File: "NES/Game.nes", Name: "Game (USA)", Platform: "NES", MD5: "0123", RawMD5: "4567", HeaderlessMD5: "0123", Matched: MatchHeaderless},
+			false,
+		},
+		{
+			"version 1, error",
+			`["/media/fat/games","NES/Bad.nes","","","","","","","permission denied"]`,
+			GameRecord{Dir: "/media/fat/games", File: "NES/Bad.nes", Error: "permission denied"},
+			false,
+		},
+		{
+			"current version",
+			` {"dir":"/media/fat/games","file":"NES/Game.zip/game.nes","member":"game.nes","size":40976,"stored":20000,"header":16,"name":"Game (USA)","platform":"NES","md5":"0123","matched":"raw"}`,
+			GameRecord{Dir: "/media/fat/games", File: "NES/Game.zip/game.nes", Member: "game.nes", Size: 40976, Stored: 20000, Header: 16, Name: "Game (USA)", Platform: "NES", MD5: "0123", Matched: MatchRaw},
+			false,
+		},
+		{"version 1, not strings", `["/media/fat/games",1]`, GameRecord{}, true},
+		{"not a record", `"NES/Game.nes"`, GameRecord{}, true},
+	}
+	for _, tt := range tests {
+		var record GameRecord
+		err := json.Unmarshal([]byte(tt.json), &record)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+		if !tt.err && !reflect.DeepEqual(record, tt.record) {
+			t.Errorf("%s: record = %+v, want %+v", tt.name, record, tt.record)
+		}
+	}
+}
+
+func TestReadWriteGameScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gamescan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Version 1 scans have no header
+	v1 := pathlib.Join(dir, "v1.jsonl")
+	lines := `["/media/fat/games","NES/Game.nes","Game (USA)","NES","0123"]` + "\n\n" +
+		`["/media/fat/games","NES/Other.nes","","","","","","",""]`
+	if err := ioutil.WriteFile(v1, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	header, records, err := ReadGameScan(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 1 || len(records) != 2 || records[1].File != "NES/Other.nes" {
+		t.Errorf("header = %+v, records = %+v", header, records)
+	}
+
+	current := pathlib.Join(dir, "current.jsonl")
+	header = GameScanHeader{Version: GameScanVersion, Path: "/media/fat/games", Created: time.Unix(1600000000, 0).UTC()}
+	if err := WriteGameScan(current, header, records); err != nil {
+		t.Fatal(err)
+	}
+	readHeader, readRecords, err := ReadGameScan(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readHeader != header || !reflect.DeepEqual(readRecords, records) {
+		t.Errorf("read %+v %+v, wrote %+v %+v", readHeader, readRecords, header, records)
+	}
+}
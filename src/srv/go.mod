@@ -10,9 +10,11 @@ require (
 	github.com/rakyll/statik v0.1.7
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/thetannerryan/ring v1.1.1
+	github.com/ulikunitz/xz v0.5.15
 	github.com/yuin/gopher-lua v0.0.0-20200521060427-6ff375d91eab
 	go.etcd.io/bbolt v1.3.4
 	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5
 	golang.org/x/tools v0.0.0-20190328211700-ab21143f2384
 	gopkg.in/ini.v1 v1.55.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -1,16 +1,40 @@
 package input
 
 import (
+	"sync"
+
 	"github.com/bendahl/uinput"
 )
 
-var Keyboard uinput.Keyboard
+var (
+	keyboard    uinput.Keyboard
+	keyboardErr error
+	once        sync.Once
+)
+
+// Keyboard returns the virtual keyboard, it is created on first use so the
+// rest of the program works without /dev/uinput.
+func Keyboard() (uinput.Keyboard, error) {
+	once.Do(func() {
+		keyboard, keyboardErr = uinput.CreateKeyboard("/dev/uinput", []byte("WebMenu Virtual Keyboard"))
+	})
+	return keyboard, keyboardErr
+}
+
+// KeyDown presses the key with the given code.
+func KeyDown(code int) error {
+	kb, err := Keyboard()
+	if err != nil {
+		return err
+	}
+	return kb.KeyDown(code)
+}
 
-func init() {
-	// initialize keyboard and check for possible errors
-	var err error
-	Keyboard, err = uinput.CreateKeyboard("/dev/uinput", []byte("WebMenu Virtual Keyboard"))
+// KeyUp releases the key with the given code.
+func KeyUp(code int) error {
+	kb, err := Keyboard()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return kb.KeyUp(code)
 }
@@ -0,0 +1,271 @@
+// Package jobs runs long tasks, like scans, in the background so they don't
+// depend on the HTTP request that started them.
+package jobs
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// States of a job.
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Done      = "done"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+)
+
+// ErrCancelled is returned by the work of a job that stopped because the job
+// was cancelled.
+var ErrCancelled = errors.New("Job cancelled")
+
+// Progress is the work done by a job so far.
+type Progress struct {
+	Seen       uint64 `json:"seen"`
+	Hashed     uint64 `json:"hashed"`
+	Identified uint64 `json:"identified"`
+	Current    string `json:"current"`
+}
+
+// Status is a snapshot of a job.
+type Status struct {
+	ID       string      `json:"id"`
+	Kind     string      `json:"kind"`
+	Target   string      `json:"target"`
+	State    string      `json:"state"`
+	Error    string      `json:"error,omitempty"`
+	Created  time.Time   `json:"created"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+	Progress Progress    `json:"progress"`
+	Result   interface{} `json:"result,omitempty"`
+}
+
+// Func does the work of a job. It should return ErrCancelled as soon as
+// possible once the job is cancelled. The result is kept in the status of
+// the job.
+type Func func(job *Job) (interface{}, error)
+
+// Job is a task run by a Manager.
+type Job struct {
+	mu       sync.Mutex
+	status   Status
+	fn       Func
+	progress func() Progress
+	cancel   chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Cancelled is closed when the job is cancelled.
+func (j *Job) Cancelled() <-chan struct{} {
+	return j.cancel
+}
+
+// Done is closed when the job is finished.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Watch sets the function that reports the progress of the job while it
+// runs.
+func (j *Job) Watch(progress func() Progress) {
+	j.mu.Lock()
+	j.progress = progress
+	j.mu.Unlock()
+}
+
+// Status returns a snapshot of the job.
+func (j *Job) Status() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.status
+	if j.progress != nil {
+		s.Progress = j.progress()
+	}
+	return s
+}
+
+// Cancel asks the job to stop. A job that didn't start yet never runs.
+func (j *Job) Cancel() {
+	j.once.Do(func() { close(j.cancel) })
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// Checked under the same lock start takes, a running job is finished
+	// by its runner
+	if j.status.State == Queued {
+		j.finishLocked(nil, ErrCancelled)
+	}
+}
+
+func (j *Job) start() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.State != Queued {
+		return false
+	}
+	j.status.State = Running
+	j.status.Started = time.Now()
+	return true
+}
+
+func (j *Job) finish(result interface{}, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishLocked(result, err)
+}
+
+func (j *Job) finishLocked(result interface{}, err error) {
+	if j.status.State != Queued && j.status.State != Running {
+		return
+	}
+	switch {
+	case err == ErrCancelled:
+		j.status.State = Cancelled
+	case err != nil:
+		j.status.State = Failed
+		j.status.Error = err.Error()
+	default:
+		j.status.State = Done
+	}
+	if j.progress != nil {
+		// The progress is frozen once the job is over
+		j.status.Progress = j.progress()
+		j.progress = nil
+	}
+	j.status.Result = result
+	j.status.Finished = time.Now()
+	close(j.done)
+}
+
+func (j *Job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Manager runs jobs one at a time, in the order they were started, holding
+// lock while they run. It keeps the status of the last finished ones.
+type Manager struct {
+	lock    sync.Locker
+	history int
+	wake    chan struct{}
+
+	mu    sync.Mutex
+	last  uint64
+	jobs  []*Job
+	queue []*Job
+}
+
+// NewManager returns a Manager that holds lock while a job runs and
+// remembers up to history finished jobs.
+func NewManager(lock sync.Locker, history int) *Manager {
+	m := &Manager{lock: lock, history: history, wake: make(chan struct{}, 1)}
+	go m.run()
+	return m
+}
+
+// Start queues a new job. Kind and target describe the job in its status.
+func (m *Manager) Start(kind, target string, fn Func) *Job {
+	m.mu.Lock()
+	m.last++
+	job := &Job{
+		status: Status{
+			ID:      strconv.FormatUint(m.last, 10),
+			Kind:    kind,
+			Target:  target,
+			State:   Queued,
+			Created: time.Now(),
+		},
+		fn:     fn,
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	m.jobs = append(m.jobs, job)
+	m.queue = append(m.queue, job)
+	m.prune()
+	m.mu.Unlock()
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+		// The worker is already awake
+	}
+	return job
+}
+
+// run is the worker of the manager, it runs the queued jobs in order.
+func (m *Manager) run() {
+	for range m.wake {
+		for {
+			m.mu.Lock()
+			if len(m.queue) == 0 {
+				m.mu.Unlock()
+				break
+			}
+			job := m.queue[0]
+			m.queue[0] = nil
+			m.queue = m.queue[1:]
+			m.mu.Unlock()
+
+			m.lock.Lock()
+			// Jobs cancelled while queued are skipped
+			if job.start() {
+				result, err := job.fn(job)
+				job.finish(result, err)
+			}
+			m.lock.Unlock()
+		}
+	}
+}
+
+// prune forgets the oldest finished jobs beyond the history size.
+func (m *Manager) prune() {
+	finished := 0
+	for _, j := range m.jobs {
+		if j.finished() {
+			finished++
+		}
+	}
+	jobs := m.jobs[:0]
+	for _, j := range m.jobs {
+		if finished > m.history && j.finished() {
+			finished--
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	m.jobs = jobs
+}
+
+// Get returns the job with the given ID.
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.status.ID == id {
+			return j, true
+		}
+	}
+	return nil, false
+}
+
+// List returns the status of every known job, oldest first.
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	jobs := make([]*Job, len(m.jobs))
+	copy(jobs, m.jobs)
+	m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(jobs))
+	for _, j := range jobs {
+		statuses = append(statuses, j.Status())
+	}
+	return statuses
+}
@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobsRunInOrder(t *testing.T) {
+	m := NewManager(&sync.Mutex{}, 50)
+
+	release := make(chan struct{})
+	first := m.Start("test", "first", func(job *Job) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	var mu sync.Mutex
+	order := make([]int, 0)
+	queued := make([]*Job, 0)
+	for i := 0; i < 20; i++ {
+		i := i
+		queued = append(queued, m.Start("test", "", func(job *Job) (interface{}, error) {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			return i, nil
+		}))
+	}
+	close(release)
+	<-first.Done()
+	for _, job := range queued {
+		<-job.Done()
+	}
+
+	for i, n := range order {
+		if i != n {
+			t.Fatalf("jobs ran in order %v", order)
+		}
+	}
+	if s := queued[3].Status(); s.State != Done || s.Result != 3 {
+		t.Errorf("status = %+v", s)
+	}
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	m := NewManager(&sync.Mutex{}, 50)
+
+	release := make(chan struct{})
+	first := m.Start("test", "", func(job *Job) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	ran := false
+	queued := m.Start("test", "", func(job *Job) (interface{}, error) {
+		ran = true
+		return nil, nil
+	})
+
+	queued.Cancel()
+	select {
+	case <-queued.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a cancelled queued job is not done")
+	}
+	close(release)
+	<-first.Done()
+
+	// Queued after the cancelled one, so that one was skipped by now
+	<-m.Start("test", "", func(job *Job) (interface{}, error) { return nil, nil }).Done()
+	if ran {
+		t.Error("a cancelled job ran")
+	}
+	if s := queued.Status(); s.State != Cancelled {
+		t.Errorf("state = %s, want %s", s.State, Cancelled)
+	}
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	m := NewManager(&sync.Mutex{}, 50)
+
+	started := make(chan struct{})
+	stopped := false
+	job := m.Start("test", "", func(job *Job) (interface{}, error) {
+		close(started)
+		<-job.Cancelled()
+		time.Sleep(10 * time.Millisecond)
+		stopped = true
+		return nil, ErrCancelled
+	})
+	<-started
+	job.Cancel()
+	<-job.Done()
+
+	// Only the runner finishes a running job
+	if !stopped {
+		t.Error("the job was done before its work stopped")
+	}
+	if s := job.Status(); s.State != Cancelled {
+		t.Errorf("state = %s, want %s", s.State, Cancelled)
+	}
+}
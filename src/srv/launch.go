@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	pathlib "path"
+	"strings"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+
+	"github.com/rakyll/statik/fs"
+)
+
+// MGLSlot tells in which file slot of a core a ROM has to be loaded.
+type MGLSlot struct {
+	Exts  []string
+	Type  string
+	Index int
+	Delay int
+}
+
+// mglSlots maps core codenames to the slots their ROMs are loaded into.
+//
+// The MGL format is described in the Main_MiSTer wiki
+// (https://github.com/MiSTer-devel/Main_MiSTer/wiki/MGL-format): "f" loads a
+// file and "s" mounts a disk image, the index is the position of that option
+// among the options of the same kind in the CONF_STR of the core, and the
+// delay is the number of seconds the core needs before the file can be sent.
+// Each slot below names the core repository its CONF_STR comes from.
+var mglSlots = map[string][]MGLSlot{
+	// MiSTer-devel/Atari7800_MiSTer, the 2600 carts use the second file option
+	"Atari2600": {{[]string{"a26", "bin"}, "f", 1, 1}},
+	// MiSTer-devel/Atari5200_MiSTer, the first file option loads the BIOS
+	"Atari5200": {{[]string{"car", "a52", "bin", "rom"}, "f", 1, 1}},
+	// MiSTer-devel/C64_MiSTer, disks mount in drive 8, the first file option
+	// is the kernal
+	"C64": {{[]string{"d64", "t64"}, "s", 0, 1}, {[]string{"prg", "crt", "tap"}, "f", 1, 1}},
+	// MiSTer-devel/ColecoVision_MiSTer, SG-1000 carts have their own option
+	"ColecoVision": {{[]string{"col", "bin", "rom"}, "f", 0, 1}, {[]string{"sg"}, "f", 1, 1}},
+	// MiSTer-devel/Gameboy_MiSTer, the first file option loads the boot ROM
+	"Gameboy": {{[]string{"gb", "gbc"}, "f", 1, 1}},
+	// MiSTer-devel/GBA_MiSTer
+	"GBA": {{[]string{"gba"}, "f", 0, 2}},
+	// MiSTer-devel/Genesis_MiSTer
+	"Genesis": {{[]string{"bin", "gen", "md"}, "f", 0, 1}},
+	// MiSTer-devel/MegaCD_MiSTer
+	"MegaCD": {{[]string{"cue", "chd"}, "s", 0, 1}},
+	// MiSTer-devel/NES_MiSTer
+	"NES": {{[]string{"nes", "fds", "nsf"}, "f", 0, 2}},
+	// MiSTer-devel/Odyssey2_MiSTer, the first file option loads the BIOS
+	"Odyssey2": {{[]string{"bin"}, "f", 1, 1}},
+	// MiSTer-devel/SMS_MiSTer, the first file option loads the BIOS
+	"SMS": {{[]string{"sms", "sg"}, "f", 1, 1}, {[]string{"gg"}, "f", 2, 1}},
+	// MiSTer-devel/SNES_MiSTer
+	"SNES": {{[]string{"sfc", "smc", "bin"}, "f", 0, 2}},
+	// MiSTer-devel/TurboGrafx16_MiSTer, CD images mount in the first disk slot
+	"TurboGrafx16": {{[]string{"pce", "bin"}, "f", 0, 1}, {[]string{"sgx"}, "f", 1, 1}, {[]string{"cue", "chd"}, "s", 0, 1}},
+	// MiSTer-devel/Vectrex_MiSTer, the first file option loads the overlay
+	"Vectrex": {{[]string{"vec", "bin", "rom"}, "f", 1, 1}},
+}
+
+// ContentLoadInfo describes a ROM to be loaded with a given core.
+type ContentLoadInfo struct {
+	CoreCodename string `json:"core_codename"`
+	CorePath     string `json:"core_path"`
+	Rom          string `json:"rom"`
+	IsZip        bool   `json:"is_zip"`
+}
+
+// FindMGLSlot returns the slot used by the core to load a ROM with the given
+// filename.
+func FindMGLSlot(codename string, rom string) (MGLSlot, bool) {
+	ext := strings.TrimLeft(strings.ToLower(pathlib.Ext(rom)), ".")
+	for _, slot := range mglSlots[codename] {
+		for _, e := range slot.Exts {
+			if e == ext {
+				return slot, true
+			}
+		}
+	}
+	return MGLSlot{}, false
+}
+
+// checkRomPath returns an error unless the ROM is an absolute path inside the
+// SD card. MiSTer loads absolute file paths as they are, relative ones would be
+// taken from the games folder of the core.
+func checkRomPath(rom string) error {
+	if !pathlib.IsAbs(rom) {
+		return fmt.Errorf("rom path %q is not absolute", rom)
+	}
+	for _, part := range strings.Split(rom, "/") {
+		if part == ".." {
+			return fmt.Errorf("rom path %q contains ..", rom)
+		}
+	}
+	if !strings.HasPrefix(pathlib.Clean(rom), system.SdPath+"/") {
+		return fmt.Errorf("rom path %q is not in %s", rom, system.SdPath)
+	}
+	return nil
+}
+
+// launchMGL returns an MGL file that loads the ROM into the given slot of the
+// core.
+func launchMGL(info ContentLoadInfo, slot MGLSlot) ([]byte, error) {
+	if err := checkRomPath(info.Rom); err != nil {
+		return nil, err
+	}
+	rbf := strings.TrimPrefix(info.CorePath, system.SdPath+"/")
+	rbf = strings.TrimSuffix(rbf, pathlib.Ext(rbf))
+
+	return xml.MarshalIndent(struct {
+		XMLName xml.Name  `xml:"mistergamedescription"`
+		Rbf     string    `xml:"rbf"`
+		Files   []MGLFile `xml:"file"`
+	}{
+		Rbf: rbf,
+		Files: []MGLFile{{
+			Delay: slot.Delay,
+			Type:  slot.Type,
+			Index: slot.Index,
+			Path:  pathlib.Clean(info.Rom),
+		}},
+	}, "", "\t")
+}
+
+// writeLaunchMGL creates a temporary MGL file that loads the ROM into the
+// given slot of the core.
+func writeLaunchMGL(info ContentLoadInfo, slot MGLSlot) (string, error) {
+	b, err := launchMGL(info, slot)
+	if err != nil {
+		return "", err
+	}
+	return system.LaunchMGLPath, ioutil.WriteFile(system.LaunchMGLPath, b, 0644)
+}
+
+// launchContentWithScript loads the content by running load.lua, which
+// navigates the core menu with simulated key presses.
+func launchContentWithScript(info ContentLoadInfo) error {
+	source, err := fs.ReadFile(statikFS, "/assets/scripts/load.lua")
+	if err != nil {
+		return err
+	}
+	return runLuaScript(LUAScript{
+		Params: map[string]interface{}{
+			"method":        "rload",
+			"core_codename": info.CoreCodename,
+			"core_path":     info.CorePath,
+			"rom":           info.Rom,
+			"is_zip":        info.IsZip,
+		},
+		Source: string(source),
+	})
+}
+
+// LaunchContentWithCore loads a ROM with the given core, using a generated
+// MGL file when the slot of the ROM is known.
+func LaunchContentWithCore(info ContentLoadInfo) error {
+	if info.CoreCodename == "" {
+		if matches := rbfNameRe.FindStringSubmatch(pathlib.Base(info.CorePath)); matches != nil {
+			info.CoreCodename = matches[1]
+		}
+	}
+
+	slot, ok := FindMGLSlot(info.CoreCodename, info.Rom)
+	if !ok {
+		return launchContentWithScript(info)
+	}
+
+	mgl, err := writeLaunchMGL(info, slot)
+	if err != nil {
+		return err
+	}
+	return launchGame(mgl)
+}
+
+func LaunchContent(w http.ResponseWriter, r *http.Request) {
+	var info ContentLoadInfo
+
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		http.Error(w, "can't decode launch request", http.StatusBadRequest)
+		return
+	}
+	if info.CorePath == "" || info.Rom == "" {
+		http.Error(w, "core_path and rom are mandatory", http.StatusBadRequest)
+		return
+	}
+	if err := checkRomPath(info.Rom); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := LaunchContentWithCore(info); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+}
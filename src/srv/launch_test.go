@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestLaunchMGL(t *testing.T) {
+	info := ContentLoadInfo{
+		CorePath: "/media/fat/_Console/NES_20210101.rbf",
+		Rom:      "/media/fat/games/NES/Some Game (USA).nes",
+	}
+	slot, ok := FindMGLSlot("NES", info.Rom)
+	if !ok {
+		t.Fatal("no slot for .nes files")
+	}
+
+	b, err := launchMGL(info, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mgl struct {
+		XMLName xml.Name  `xml:"mistergamedescription"`
+		Rbf     string    `xml:"rbf"`
+		Files   []MGLFile `xml:"file"`
+	}
+	if err := xml.Unmarshal(b, &mgl); err != nil {
+		t.Fatal(err)
+	}
+
+	if mgl.Rbf != "_Console/NES_20210101" {
+		t.Errorf("rbf = %q", mgl.Rbf)
+	}
+	if len(mgl.Files) != 1 {
+		t.Fatalf("%d files, want 1", len(mgl.Files))
+	}
+	want := MGLFile{Delay: 2, Type: "f", Index: 0, Path: info.Rom}
+	if mgl.Files[0] != want {
+		t.Errorf("file = %+v, want %+v", mgl.Files[0], want)
+	}
+}
+
+func TestFindMGLSlot(t *testing.T) {
+	tests := []struct {
+		codename string
+		rom      string
+		ok       bool
+		typ      string
+		index    int
+		delay    int
+	}{
+		{"NES", "game.nes", true, "f", 0, 2},
+		{"NES", "GAME.FDS", true, "f", 0, 2},
+		{"SNES", "game.sfc", true, "f", 0, 2},
+		{"GBA", "game.gba", true, "f", 0, 2},
+		{"Genesis", "game.md", true, "f", 0, 1},
+		{"Gameboy", "game.gbc", true, "f", 1, 1},
+		{"Atari2600", "game.a26", true, "f", 1, 1},
+		{"C64", "disk.d64", true, "s", 0, 1},
+		{"C64", "game.prg", true, "f", 1, 1},
+		{"ColecoVision", "game.col", true, "f", 0, 1},
+		{"ColecoVision", "game.sg", true, "f", 1, 1},
+		{"SMS", "game.sms", true, "f", 1, 1},
+		{"SMS", "game.gg", true, "f", 2, 1},
+		{"MegaCD", "game.chd", true, "s", 0, 1},
+		{"TurboGrafx16", "game.pce", true, "f", 0, 1},
+		{"TurboGrafx16", "game.sgx", true, "f", 1, 1},
+		{"TurboGrafx16", "game.cue", true, "s", 0, 1},
+		{"Vectrex", "game.vec", true, "f", 1, 1},
+		{"NES", "game.sfc", false, "", 0, 0},
+		{"NES", "game", false, "", 0, 0},
+		{"Unknown", "game.nes", false, "", 0, 0},
+	}
+	for _, tt := range tests {
+		slot, ok := FindMGLSlot(tt.codename, tt.rom)
+		if ok != tt.ok || slot.Type != tt.typ || slot.Index != tt.index || slot.Delay != tt.delay {
+			t.Errorf("%s %s: slot = %+v %v, want %s %d %d %v", tt.codename, tt.rom, slot, ok, tt.typ, tt.index, tt.delay, tt.ok)
+		}
+	}
+}
+
+func TestMGLSlotsAreValid(t *testing.T) {
+	for codename, slots := range mglSlots {
+		seen := make(map[string]bool)
+		for _, slot := range slots {
+			if slot.Type != "f" && slot.Type != "s" {
+				t.Errorf("%s: slot type %q", codename, slot.Type)
+			}
+			if slot.Index < 0 || slot.Delay < 1 {
+				t.Errorf("%s: slot %+v", codename, slot)
+			}
+			for _, ext := range slot.Exts {
+				if seen[ext] {
+					t.Errorf("%s: .%s is in two slots", codename, ext)
+				}
+				seen[ext] = true
+			}
+		}
+	}
+}
+
+func TestCheckRomPath(t *testing.T) {
+	tests := []struct {
+		rom string
+		ok  bool
+	}{
+		{"/media/fat/games/NES/game.nes", true},
+		{"/media/fat/games/NES/pack.zip/game.nes", true},
+		{"NES/game.nes", false},
+		{"/media/usb0/games/NES/game.nes", false},
+		{"/media/fat", false},
+		{"/media/fatter/game.nes", false},
+		{"/media/fat/../../etc/passwd", false},
+		{"/media/fat/games/NES/pack.zip/../game.nes", false},
+		{"/media/fat/games/..hidden.nes", true},
+	}
+	for _, tt := range tests {
+		if err := checkRomPath(tt.rom); (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v", tt.rom, err)
+		}
+	}
+}
+
+func TestLaunchMGLRejectsRom(t *testing.T) {
+	for _, rom := range []string{"NES/game.nes", "/media/fat/../tmp/game.nes", "/tmp/game.nes"} {
+		info := ContentLoadInfo{CorePath: "/media/fat/_Console/NES_20210101.rbf", Rom: rom}
+		if _, err := launchMGL(info, MGLSlot{}); err == nil {
+			t.Errorf("%s: rom path accepted", rom)
+		}
+	}
+}
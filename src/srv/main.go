@@ -1,9 +1,7 @@
 package main
 
 import (
-	"archive/zip"
 	"crypto/md5"
-	"encoding/binary"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -19,22 +17,25 @@ import (
 	pathlib "path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
 	"github.com/nilp0inter/MiSTer_WebMenu/fastwalk"
 	"github.com/nilp0inter/MiSTer_WebMenu/input"
+	"github.com/nilp0inter/MiSTer_WebMenu/jobs"
+	"github.com/nilp0inter/MiSTer_WebMenu/platforms"
 	_ "github.com/nilp0inter/MiSTer_WebMenu/statik"
 	"github.com/nilp0inter/MiSTer_WebMenu/system"
 	"github.com/nilp0inter/MiSTer_WebMenu/update"
 
 	"github.com/gorilla/mux"
 	"github.com/rakyll/statik/fs"
-	"github.com/thetannerryan/ring"
 	lua "github.com/yuin/gopher-lua"
-	bolt "go.etcd.io/bbolt"
 )
 
 // Version is obtained at compile time
@@ -42,24 +43,90 @@ var Version = "<Version>"
 
 var scanMutex = &sync.Mutex{}
 
+var statikFS http.FileSystem
+
+// CoresDBVersion must be increased whenever the information stored for a
+// core changes, so entries from older databases are scanned again.
+const CoresDBVersion = 7
+
 type Cores struct {
-	RBFs []RBF `json:"rbfs"`
-	MRAs []MRA `json:"mras"`
+	Version int   `json:"version"`
+	RBFs    []RBF `json:"rbfs"`
+	MRAs    []MRA `json:"mras"`
+	MGLs    []MGL `json:"mgls"`
+
+	// Builds of the RBFs grouped by codename
+	RBFGroups []RBFGroup     `json:"rbf_groups"`
+	Families  []ArcadeFamily `json:"families"`
 }
 
 type MRA struct {
-	Path      string   `json:"path"`
-	Filename  string   `json:"filename"`
-	Ctime     int64    `json:"ctime"`
-	LogicPath []string `json:"lpath"`
-	MD5       string   `json:"md5"`
-	Name      string   `json:"name" xml:"name"`
-	Rbf       string   `xml:"rbf" json:"-"`
-	Roms      []struct {
-		Zip   string `xml:"zip,attr" json:"zip"`
-		Index string `xml:"index,attr" json:"-"`
-	} `xml:"rom" json:"roms"`
-	RomsFound bool `json:"roms_found"`
+	Path         string   `json:"path"`
+	Filename     string   `json:"filename"`
+	Size         int64    `json:"size"`
+	Ctime        int64    `json:"ctime"`
+	LogicPath    []string `json:"lpath"`
+	MD5          string   `json:"md5"`
+	Name         string   `json:"name" xml:"name"`
+	Setname      string   `json:"setname" xml:"setname"`
+	Parent       string   `json:"parent" xml:"parent"`
+	Year         string   `json:"year" xml:"year"`
+	Manufacturer string   `json:"manufacturer" xml:"manufacturer"`
+	Category     string   `json:"category" xml:"category"`
+	Rotation     string   `json:"rotation" xml:"rotation"`
+	Players      string   `json:"players" xml:"players"`
+	Buttons      struct {
+		Names   string `xml:"names,attr" json:"names"`
+		Default string `xml:"default,attr" json:"default"`
+	} `xml:"buttons" json:"buttons"`
+	Region      string   `json:"region" xml:"region"`
+	MameVersion string   `json:"mameversion" xml:"mameversion"`
+	Rbf         string   `xml:"rbf" json:"rbf"`
+	RbfPath     string   `json:"rbf_path"`
+	CoreStatus  string   `json:"core_status"`
+	Roms        []MRARom `xml:"rom" json:"roms"`
+	RomsFound   bool     `json:"roms_found"`
+	Zips        []string `json:"zips"`
+	Audit       RomAudit `json:"audit"`
+	// Paths, sizes and modification times of the zips the audit read
+	ZipsStamp string `json:"zips_stamp,omitempty"`
+	Family    string `json:"family"`
+	Clone     bool   `json:"clone"`
+}
+
+type MRARom struct {
+	Zip        string    `xml:"zip,attr" json:"zip"`
+	Index      string    `xml:"index,attr" json:"index"`
+	Parts      []MRAPart `xml:"part" json:"parts,omitempty"`
+	Interleave []MRAPart `xml:"interleave>part" json:"interleave,omitempty"`
+}
+
+type MRAPart struct {
+	Name string `xml:"name,attr" json:"name"`
+	CRC  string `xml:"crc,attr" json:"crc"`
+	Zip  string `xml:"zip,attr" json:"zip,omitempty"`
+}
+
+// MGL is a MiSTer Game Launcher file: a shortcut that loads a core together
+// with one or more files.
+type MGL struct {
+	Path      string    `json:"path"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Ctime     int64     `json:"ctime"`
+	LogicPath []string  `json:"lpath"`
+	MD5       string    `json:"md5"`
+	Name      string    `json:"name"`
+	Rbf       string    `xml:"rbf" json:"rbf"`
+	Setname   string    `xml:"setname" json:"setname"`
+	Files     []MGLFile `xml:"file" json:"files"`
+}
+
+type MGLFile struct {
+	Delay int    `xml:"delay,attr" json:"delay"`
+	Type  string `xml:"type,attr" json:"type"`
+	Index int    `xml:"index,attr" json:"index"`
+	Path  string `xml:"path,attr" json:"path"`
 }
 
 type RBF struct {
@@ -67,13 +134,44 @@ type RBF struct {
 	Filename  string   `json:"filename"`
 	Codename  string   `json:"codename"`
 	Codedate  string   `json:"codedate"`
+	Current   bool     `json:"current"`
+	Platform  string   `json:"platform,omitempty"`
+	Size      int64    `json:"size"`
 	Ctime     int64    `json:"ctime"`
 	LogicPath []string `json:"lpath"`
 	MD5       string   `json:"md5"`
 }
 
+// CoresScanSummary lists the paths of the cores that changed between two
+// scans. Failed are the new or changed files that could not be read, they
+// are left out of the database.
+type CoresScanSummary struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+	Failed  []string `json:"failed"`
+}
+
+// CoresScan keeps the state of an incremental core scan. Entries from the
+// previous scan are reused when the size and modification time of the file
+// did not change.
+type CoresScan struct {
+	Cores    Cores
+	Summary  CoresScanSummary
+	stale    bool
+	prevRBFs map[string]RBF
+	prevMRAs map[string]MRA
+	prevMGLs map[string]MGL
+
+	// Scanning stops when cancel is closed
+	cancel  <-chan struct{}
+	seen    uint64
+	parsed  uint64
+	current atomic.Value
+}
+
 type LUAScript struct {
-	Params map[string]interface{} `json:params"`
+	Params map[string]interface{} `json:"params"`
 	Source string                 `json:"source"`
 }
 
@@ -86,6 +184,7 @@ func scanMRA(filename string) (MRA, error) {
 	if err != nil {
 		return c, err
 	}
+	c.Size = fi.Size()
 	c.Ctime = fi.ModTime().Unix()
 
 	// MD5
@@ -115,54 +214,120 @@ func scanMRA(filename string) (MRA, error) {
 		return c, err
 	}
 
-	c.RomsFound = len(c.Roms) == 0
 	rp := 0
 	for i := 0; i < len(c.Roms); i++ {
 		rom := c.Roms[i]
-		if rom.Zip == "" || rom.Index != "0" {
+		if !usesZips(rom) {
 			continue
 		}
 		c.Roms[rp] = rom
 		rp++
+	}
+	c.Roms = c.Roms[:rp]
+
+	resolveRomZips(&c)
+	return c, nil
+}
+
+// usesZips tells whether the parts of a rom are loaded from zips.
+func usesZips(rom MRARom) bool {
+	if rom.Zip != "" {
+		return true
+	}
+	for _, part := range append(rom.Parts, rom.Interleave...) {
+		if part.Zip != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRomZips looks for the ROM zips of an MRA and audits them. It runs
+// for every MRA on every scan, the zips change without the MRA changing. The
+// audit of the previous scan is kept when the same zips are found, with the
+// same sizes and modification times. Only the zips of the game ROM, index 0,
+// tell whether the ROMs were found.
+func resolveRomZips(c *MRA) {
+	baseDir := pathlib.Dir(c.Path)
+	hasGame, gameFound := false, false
+	zips := make([]string, 0)
+	for _, rom := range c.Roms {
 		thisFound := false
-	romLoop:
 		for _, zip := range strings.Split(rom.Zip, "|") {
-			_, err = os.Stat(path.Join(system.GamesPath, "mame", zip))
-			if err == nil {
-				thisFound = true
-				break romLoop
+			if zip == "" {
+				continue
 			}
-			_, err = os.Stat(path.Join(system.GamesPath, "hbmame", zip))
-			if err == nil {
+			if zipPath, ok := findRomZip(baseDir, zip); ok {
+				zips = append(zips, zipPath)
 				thisFound = true
-				break romLoop
 			}
-			parent := filepath.Clean(path.Join(system.SdPath, "..", "..")) //Double .. to include /media/fat
-			for p := baseDir; filepath.Clean(p) != parent; p = path.Join(p, "..") {
-				_, err := os.Stat(path.Join(p, zip))
-				if err == nil {
-					thisFound = true
-					break romLoop
-				}
-				_, err = os.Stat(path.Join(p, "mame", zip))
-				if err == nil {
-					thisFound = true
-					break romLoop
-				}
-				_, err = os.Stat(path.Join(p, "hbmame", zip))
-				if err == nil {
-					thisFound = true
-					break romLoop
+		}
+		if rom.Zip != "" && rom.Index == "0" {
+			hasGame = true
+			gameFound = gameFound || thisFound
+		}
+		for _, part := range append(rom.Parts, rom.Interleave...) {
+			for _, zip := range strings.Split(part.Zip, "|") {
+				if zipPath, ok := findRomZip(baseDir, zip); ok && zip != "" {
+					zips = append(zips, zipPath)
 				}
 			}
 		}
-		c.RomsFound = c.RomsFound || thisFound
 	}
-	c.Roms = c.Roms[:rp]
 
-	return c, nil
+	stamp := zipsStamp(uniqueStrings(zips))
+	if c.ZipsStamp != "" && c.ZipsStamp == stamp {
+		return
+	}
+	c.Audit, c.Zips = auditMRA(c.Roms, baseDir, zips)
+	c.RomsFound = (!hasGame || gameFound) && c.Audit.Status == AuditComplete
+	c.ZipsStamp = stamp
+}
+
+// zipsStamp identifies the contents of the given zips by their paths, sizes
+// and modification times.
+func zipsStamp(zips []string) string {
+	var b strings.Builder
+	for _, z := range zips {
+		fi, err := os.Stat(z)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", z, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String()
 }
 
+// romZipDirs returns the folders where the MiSTer looks for the ROM zips of
+// an MRA: games/mame, games/hbmame and every parent folder of the MRA.
+func romZipDirs(baseDir string) []string {
+	dirs := []string{
+		path.Join(system.GamesPath, "mame"),
+		path.Join(system.GamesPath, "hbmame"),
+	}
+	parent := filepath.Clean(path.Join(system.SdPath, "..", "..")) //Double .. to include /media/fat
+	for p := baseDir; filepath.Clean(p) != parent; p = path.Join(p, "..") {
+		dirs = append(dirs,
+			filepath.Clean(p),
+			path.Join(p, "mame"),
+			path.Join(p, "hbmame"))
+	}
+	return dirs
+}
+
+// findRomZip looks for an arcade ROM zip in the folders of romZipDirs.
+func findRomZip(baseDir string, zip string) (string, bool) {
+	for _, dir := range romZipDirs(baseDir) {
+		candidate := path.Join(dir, zip)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+var rbfNameRe = regexp.MustCompile(`^([^_]+)_(\d{8})[^\.]*\.rbf$`)
+
 func scanRBF(filename string) (RBF, error) {
 	var c RBF
 
@@ -172,6 +337,7 @@ func scanRBF(filename string) (RBF, error) {
 	if err != nil {
 		return c, err
 	}
+	c.Size = fi.Size()
 	c.Ctime = fi.ModTime().Unix()
 
 	// MD5
@@ -190,8 +356,7 @@ func scanRBF(filename string) (RBF, error) {
 	// NAME
 	c.Filename = pathlib.Base(filename)
 
-	re := regexp.MustCompile(`^([^_]+)_(\d{8})[^\.]*\.rbf$`)
-	matches := re.FindStringSubmatch(c.Filename)
+	matches := rbfNameRe.FindStringSubmatch(c.Filename)
 	if matches != nil {
 		c.Codename = string(matches[1])
 		c.Codedate = string(matches[2])
@@ -207,6 +372,51 @@ func scanRBF(filename string) (RBF, error) {
 	return c, nil
 }
 
+func scanMGL(filename string) (MGL, error) {
+	var c MGL
+
+	// Path
+	c.Path = filename
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return c, err
+	}
+	c.Size = fi.Size()
+	c.Ctime = fi.ModTime().Unix()
+
+	// MD5
+	x, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return c, err
+	}
+	c.MD5 = fmt.Sprintf("%x", md5.Sum(x))
+
+	// NAME
+	c.Filename = pathlib.Base(filename)
+	c.Name = strings.TrimSuffix(c.Filename, pathlib.Ext(c.Filename))
+
+	// LPATH
+	c.LogicPath = make([]string, 0)
+	for _, d := range strings.Split(strings.TrimPrefix(pathlib.Dir(filename), system.SdPath), "/") {
+		if strings.HasPrefix(d, "_") {
+			c.LogicPath = append(c.LogicPath, strings.TrimLeft(d, "_"))
+		}
+	}
+
+	err = xml.Unmarshal(x, &c)
+	if err != nil {
+		return c, err
+	}
+	if c.Rbf == "" {
+		return c, errors.New("MGL without rbf")
+	}
+	if c.Files == nil {
+		c.Files = make([]MGLFile, 0)
+	}
+
+	return c, nil
+}
+
 func launchGame(filename string) error {
 	return ioutil.WriteFile(system.MisterFifo, []byte("load_core "+filename), 0644)
 }
@@ -284,7 +494,21 @@ func main() {
 	greetUser()
 	createCache()
 
-	statikFS, err := fs.New()
+	// The device is created early, the system takes a moment to pick it up
+	if _, err := input.Keyboard(); err != nil {
+		log.Println(err)
+	}
+
+	if err := platforms.Load(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ConvertGameScans(); err != nil {
+		log.Println(err)
+	}
+
+	var err error
+	statikFS, err = fs.New()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -295,13 +519,29 @@ func main() {
 	r.HandleFunc("/api/update", PerformUpdate).Methods("POST")
 	r.HandleFunc("/api/script/run", RunScript).Methods("POST")
 	r.HandleFunc("/api/run", RunCoreWithGame)
+	r.HandleFunc("/api/games/launch", LaunchContent).Methods("POST")
 	r.HandleFunc("/api/input", SendInput)
 	r.HandleFunc("/api/version/current", GetCurrentVersion)
+	r.HandleFunc("/api/platforms", GetPlatforms).Methods("GET")
 	r.HandleFunc("/api/folder/scan", ScanForFolders)
 	r.HandleFunc("/api/cores/scan", ScanForCores)
+	r.HandleFunc("/api/cores/romzips", GetRomZipReport).Methods("GET")
+	r.HandleFunc("/api/cores/stale", ListStaleCores).Methods("GET")
+	r.HandleFunc("/api/cores/quarantine", ListQuarantinedCores).Methods("GET")
+	r.HandleFunc("/api/cores/quarantine", QuarantineCores).Methods("POST")
+	r.HandleFunc("/api/cores/quarantine", RestoreCores).Methods("DELETE")
 	r.HandleFunc("/api/games/scan", ScanForGames).Methods("GET")
 	r.HandleFunc("/api/games/scan", DeleteGameScan).Methods("DELETE")
+	r.HandleFunc("/api/games/scan/stats", GetGameScanStats).Methods("GET")
+	r.HandleFunc("/api/games/duplicates", GetDuplicateReport).Methods("GET")
+	r.HandleFunc("/api/games/completeness", GetCompletenessReport).Methods("GET")
 	r.HandleFunc("/api/games/db/update", UpdateGameDB).Methods("POST")
+	r.HandleFunc("/api/games/db/dats", ListDATs).Methods("GET")
+	r.HandleFunc("/api/games/db/dats", ImportDAT).Methods("POST")
+	r.HandleFunc("/api/jobs", ListJobs).Methods("GET")
+	r.HandleFunc("/api/jobs/scan/{kind}", StartScanJob).Methods("POST")
+	r.HandleFunc("/api/jobs/{id}", GetJob).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}", CancelJob).Methods("DELETE")
 	r.PathPrefix("/cached/").Handler(http.StripPrefix("/cached/", http.FileServer(http.Dir(system.CachePath))))
 	r.PathPrefix("/").Handler(NoCache(http.FileServer(statikFS)))
 
@@ -322,7 +562,102 @@ func GetCurrentVersion(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(Version))
 }
 
-func ScanPath(base string, file os.FileInfo, cores *Cores) {
+func NewCoresScan(previous *Cores) *CoresScan {
+	scan := &CoresScan{
+		prevRBFs: make(map[string]RBF),
+		prevMRAs: make(map[string]MRA),
+		prevMGLs: make(map[string]MGL),
+	}
+	scan.Cores.Version = CoresDBVersion
+	scan.Cores.RBFs = make([]RBF, 0)
+	scan.Cores.MRAs = make([]MRA, 0)
+	scan.Cores.MGLs = make([]MGL, 0)
+	scan.Summary.Added = make([]string, 0)
+	scan.Summary.Removed = make([]string, 0)
+	scan.Summary.Changed = make([]string, 0)
+	scan.Summary.Failed = make([]string, 0)
+	if previous != nil {
+		scan.stale = previous.Version != CoresDBVersion
+		for _, c := range previous.RBFs {
+			scan.prevRBFs[c.Path] = c
+		}
+		for _, c := range previous.MRAs {
+			scan.prevMRAs[c.Path] = c
+		}
+		for _, c := range previous.MGLs {
+			scan.prevMGLs[c.Path] = c
+		}
+	}
+	return scan
+}
+
+// Progress returns the number of core files found and read so far.
+func (s *CoresScan) Progress() jobs.Progress {
+	current, _ := s.current.Load().(string)
+	return jobs.Progress{
+		Seen:    atomic.LoadUint64(&s.seen),
+		Hashed:  atomic.LoadUint64(&s.parsed),
+		Current: current,
+	}
+}
+
+func (s *CoresScan) visit(filepath string) {
+	atomic.AddUint64(&s.seen, 1)
+	s.current.Store(filepath)
+}
+
+func unchanged(file os.FileInfo, size, ctime int64) bool {
+	return file.Size() == size && file.ModTime().Unix() == ctime
+}
+
+// track records whether the file at filepath is new or changed since the
+// previous scan.
+func (s *CoresScan) track(filepath string, existed bool) {
+	if existed {
+		s.Summary.Changed = append(s.Summary.Changed, filepath)
+	} else {
+		s.Summary.Added = append(s.Summary.Added, filepath)
+	}
+}
+
+// Finish adds the entries of the previous scan that were not found again to
+// the removed list.
+func (s *CoresScan) Finish() {
+	for p := range s.prevRBFs {
+		s.Summary.Removed = append(s.Summary.Removed, p)
+	}
+	for p := range s.prevMRAs {
+		s.Summary.Removed = append(s.Summary.Removed, p)
+	}
+	for p := range s.prevMGLs {
+		s.Summary.Removed = append(s.Summary.Removed, p)
+	}
+	sort.Strings(s.Summary.Removed)
+
+	markCurrentRBFs(s.Cores.RBFs)
+	s.Cores.RBFGroups = groupRBFs(s.Cores.RBFs)
+	for i := range s.Cores.RBFs {
+		s.Cores.RBFs[i].Platform = ""
+		if p, ok := platforms.ByCodename(s.Cores.RBFs[i].Codename); ok {
+			s.Cores.RBFs[i].Platform = p.Shortname
+		}
+	}
+	resolveArcadeCores(s.Cores.MRAs, s.Cores.RBFs)
+	s.Cores.Families = groupArcadeFamilies(s.Cores.MRAs)
+}
+
+func GetPlatforms(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(platforms.Platforms)
+}
+
+func ScanPath(base string, file os.FileInfo, scan *CoresScan) {
+	select {
+	case <-scan.cancel:
+		return
+	default:
+	}
+
 	ext := strings.ToLower(pathlib.Ext(file.Name()))
 	isPrefix := strings.HasPrefix(file.Name(), "_")
 	filepath := path.Join(base, file.Name())
@@ -332,55 +667,126 @@ func ScanPath(base string, file os.FileInfo, cores *Cores) {
 			return
 		}
 		for _, entry := range files {
-			ScanPath(filepath, entry, cores)
+			ScanPath(filepath, entry, scan)
 		}
 	} else if file.Mode().IsRegular() && ext == ".rbf" {
+		prev, existed := scan.prevRBFs[filepath]
+		delete(scan.prevRBFs, filepath)
+		scan.visit(filepath)
+		if existed && !scan.stale && unchanged(file, prev.Size, prev.Ctime) {
+			scan.Cores.RBFs = append(scan.Cores.RBFs, prev)
+			return
+		}
 		fmt.Printf("RBF: %s\n", filepath)
+		atomic.AddUint64(&scan.parsed, 1)
 		c, err := scanRBF(filepath)
 		if err != nil {
 			log.Println(filepath, err)
+			scan.Summary.Failed = append(scan.Summary.Failed, filepath)
 		} else {
-			cores.RBFs = append(cores.RBFs, c)
+			scan.Cores.RBFs = append(scan.Cores.RBFs, c)
+			scan.track(filepath, existed)
 		}
 	} else if file.Mode().IsRegular() && ext == ".mra" {
+		prev, existed := scan.prevMRAs[filepath]
+		delete(scan.prevMRAs, filepath)
+		scan.visit(filepath)
+		if existed && !scan.stale && unchanged(file, prev.Size, prev.Ctime) {
+			resolveRomZips(&prev)
+			scan.Cores.MRAs = append(scan.Cores.MRAs, prev)
+			return
+		}
 		fmt.Printf("MRA: %s\n", filepath)
+		atomic.AddUint64(&scan.parsed, 1)
 		c, err := scanMRA(filepath)
 		if err != nil {
 			log.Println(filepath, err)
+			scan.Summary.Failed = append(scan.Summary.Failed, filepath)
+		} else {
+			scan.Cores.MRAs = append(scan.Cores.MRAs, c)
+			scan.track(filepath, existed)
+		}
+	} else if file.Mode().IsRegular() && ext == ".mgl" {
+		prev, existed := scan.prevMGLs[filepath]
+		delete(scan.prevMGLs, filepath)
+		scan.visit(filepath)
+		if existed && !scan.stale && unchanged(file, prev.Size, prev.Ctime) {
+			scan.Cores.MGLs = append(scan.Cores.MGLs, prev)
+			return
+		}
+		fmt.Printf("MGL: %s\n", filepath)
+		atomic.AddUint64(&scan.parsed, 1)
+		c, err := scanMGL(filepath)
+		if err != nil {
+			log.Println(filepath, err)
+			scan.Summary.Failed = append(scan.Summary.Failed, filepath)
 		} else {
-			cores.MRAs = append(cores.MRAs, c)
+			scan.Cores.MGLs = append(scan.Cores.MGLs, c)
+			scan.track(filepath, existed)
 		}
 	}
 }
 
-func ScanForCores(w http.ResponseWriter, r *http.Request) {
-	scanMutex.Lock()
-	defer scanMutex.Unlock()
+// LoadCores reads the cores database written by the last scan.
+func LoadCores() (*Cores, error) {
+	b, err := ioutil.ReadFile(system.CoresDBPath)
+	if err != nil {
+		return nil, err
+	}
+	var cores Cores
+	if err := json.Unmarshal(b, &cores); err != nil {
+		return nil, err
+	}
+	return &cores, nil
+}
 
-	force, ok := r.URL.Query()["force"]
-	doForce := ok && force[0] == "1"
+// ScanCoresAndSave scans the SD card for cores and updates the cores
+// database. Unless force is set, the scan only happens when there is no
+// database yet. When job is not nil it can cancel the scan and is told about
+// its progress.
+func ScanCoresAndSave(force bool, job *jobs.Job) (CoresScanSummary, error) {
+	previous, err := LoadCores()
+	if err != nil && !os.IsNotExist(err) {
+		// A corrupt database just means everything gets scanned again
+		log.Println(system.CoresDBPath, err)
+	}
 
-	if _, err := os.Stat(system.CoresDBPath); doForce || err != nil {
-		var cores Cores
-		cores.MRAs = make([]MRA, 0)
-		cores.RBFs = make([]RBF, 0)
+	scan := NewCoresScan(previous)
+	if !force && previous != nil {
+		return scan.Summary, nil
+	}
+	if job != nil {
+		scan.cancel = job.Cancelled()
+		job.Watch(scan.Progress)
+	}
 
-		// Scan for RBFs & MRAs
-		topLevels, err := ioutil.ReadDir(system.SdPath)
-		for _, root := range topLevels {
-			ScanPath(system.SdPath, root, &cores)
-		}
+	// Scan for RBFs & MRAs
+	topLevels, _ := ioutil.ReadDir(system.SdPath)
+	for _, root := range topLevels {
+		ScanPath(system.SdPath, root, scan)
+	}
+	select {
+	case <-scan.cancel:
+		return scan.Summary, jobs.ErrCancelled
+	default:
+	}
+	scan.Finish()
 
-		b, err := json.Marshal(cores)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = ioutil.WriteFile(system.CoresDBPath, b, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
+	b, err := json.Marshal(scan.Cores)
+	if err != nil {
+		return scan.Summary, err
 	}
-	w.WriteHeader(http.StatusOK)
+	err = ioutil.WriteFile(system.CoresDBPath, b, 0644)
+	return scan.Summary, err
+}
+
+func ScanForCores(w http.ResponseWriter, r *http.Request) {
+	job, err := startScanJob(r, "cores")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	waitForJob(w, r, job)
 }
 
 func RunCoreWithGame(w http.ResponseWriter, r *http.Request) {
@@ -449,29 +855,34 @@ func RunScript(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "can't read body", http.StatusBadRequest)
 		return
 	}
-	L := lua.NewState()
-	defer L.Close()
-	L.SetGlobal("key_press", L.NewFunction(LUAKeyPress))
-	L.SetGlobal("sleep", L.NewFunction(LUASleep))
-	L.SetGlobal("load_core", L.NewFunction(LUALoadCore))
-	L.SetGlobal("mount", L.NewFunction(LUAMount))
-	L.SetGlobal("match", L.NewFunction(LUAMatch))
 
 	if err := json.Unmarshal(body, &res); err != nil {
 		http.Error(w, "can't decode script", http.StatusBadRequest)
 		return
 	}
 
-	for k, v := range res.Params {
-		L.SetGlobal(k, ToLValue(v))
-	}
-	if err := L.DoString(res.Source); err != nil {
+	if err := runLuaScript(res); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	return
 }
 
+func runLuaScript(script LUAScript) error {
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("key_press", L.NewFunction(LUAKeyPress))
+	L.SetGlobal("sleep", L.NewFunction(LUASleep))
+	L.SetGlobal("load_core", L.NewFunction(LUALoadCore))
+	L.SetGlobal("mount", L.NewFunction(LUAMount))
+	L.SetGlobal("match", L.NewFunction(LUAMatch))
+
+	for k, v := range script.Params {
+		L.SetGlobal(k, ToLValue(v))
+	}
+	return L.DoString(script.Source)
+}
+
 func mount(src, dst string) error {
 	cmd := exec.Command("/bin/mount", "-o", "rbind,ro", src, dst)
 	if err := cmd.Start(); err != nil {
@@ -599,13 +1010,13 @@ func LUASleep(L *lua.LState) int {
 
 func LUAKeyPress(L *lua.LState) int {
 	code := L.ToInt(1)
-	err := input.Keyboard.KeyDown(code)
+	err := input.KeyDown(code)
 	if err != nil {
 		L.Push(lua.LFalse)
 		return 1
 	}
 	time.Sleep(100 * time.Millisecond)
-	err = input.Keyboard.KeyUp(code)
+	err = input.KeyUp(code)
 	if err != nil {
 		L.Push(lua.LFalse)
 		return 1
@@ -635,14 +1046,14 @@ func SendInput(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
-	err = input.Keyboard.KeyDown(int(code))
+	err = input.KeyDown(int(code))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 	time.Sleep(100 * time.Millisecond)
-	err = input.Keyboard.KeyUp(int(code))
+	err = input.KeyUp(int(code))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
@@ -651,87 +1062,33 @@ func SendInput(w http.ResponseWriter, r *http.Request) {
 }
 
 func DeleteGameScan(w http.ResponseWriter, r *http.Request) {
-	scanMutex.Lock()
-	defer scanMutex.Unlock()
 	scanPathParam, ok := r.URL.Query()["path"]
 	if !ok {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	scanPath := path.Clean(scanPathParam[0])
-	outputDir := pathlib.Join(system.GamesDBPath, pathlib.Dir(scanPath))
-
-	err := os.Remove(pathlib.Join(outputDir, pathlib.Base(scanPath)+".jsonl"))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
-	}
 
-	err = ScanFoldersAndSave("/media", true)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-	}
+	// Queued behind the scans, one may be writing the same files
+	job := scanJobs.Start("delete", scanPath, func(job *jobs.Job) (interface{}, error) {
+		if err := os.Remove(gameScanPath(scanPath)); err != nil {
+			return nil, err
+		}
+		if err := RemoveFingerprintIndex(scanPath); err != nil {
+			return nil, err
+		}
+		return nil, ScanFoldersAndSave("/media", true)
+	})
+	waitForJob(w, r, job)
 }
 
 func ScanForGames(w http.ResponseWriter, r *http.Request) {
-	scanMutex.Lock()
-	defer scanMutex.Unlock()
-
-	// Check for databank and download if not present
-	_, err := os.Stat(pathlib.Join(system.CachePath, "databank.db"))
-	if os.IsNotExist(err) {
-		err = update.UpdateGameDB()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
-	}
-
-	games := make(chan [5]string)
-	scanPathParam, ok := r.URL.Query()["path"]
-	if !ok {
-		return
-	}
-
-	scanPath := path.Clean(scanPathParam[0])
-	outputDir := pathlib.Join(system.GamesDBPath, pathlib.Dir(scanPath))
-	os.MkdirAll(outputDir, 0600)
-
-	f, err := os.Create(pathlib.Join(outputDir, pathlib.Base(scanPath)+".jsonl"))
+	job, err := startScanJob(r, "games")
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer f.Close()
-
-	enc := json.NewEncoder(f)
-
-	go func() {
-		err := ScanGames(scanPath, games)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
-	}()
-
-	for game := range games {
-		if err := enc.Encode(&game); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
-	}
-
-	err = ScanFoldersAndSave("/media", true)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-	}
+	waitForJob(w, r, job)
 }
 
 func IsKnownExt(ext string) bool {
@@ -773,7 +1130,8 @@ func IsKnownExt(ext string) bool {
 		// MSX
 		// "vhd",
 		// TODO: MacPlus
-		// TODO: Minimig
+		// Minimig
+		"adf",
 		// TODO: MultiComp
 		// TODO: ORAO
 		// Oric
@@ -841,12 +1199,14 @@ func IsKnownExt(ext string) bool {
 		// "bin",
 		"gen", "md",
 		// MegaCD
-		"cue",
+		"cue", "chd",
 		// "bin",
 		// "gen",
 		// "md",
 		// NES
 		"nes", "fds", "nsf",
+		// AtariLynx
+		"lnx",
 		// "bin",
 		// TODO: NeoGeo
 		// Odyssey2
@@ -871,168 +1231,6 @@ func IsKnownExt(ext string) bool {
 	return false
 }
 
-func ScanZipForGames(basePath string, filename string, file *zip.ReadCloser, db *bolt.DB, crc_ring, size_ring *ring.Ring, games chan<- [5]string) error {
-	buf_size := make([]byte, 8)
-	for _, zf := range file.File {
-		zipDir := pathlib.Dir(filename)
-		zipName := pathlib.Base(filename)
-		ext := strings.TrimLeft(strings.ToLower(filepath.Ext(zf.FileHeader.Name)), ".")
-		if IsKnownExt(ext) {
-			// Check SIZE against bloom
-			binary.LittleEndian.PutUint64(buf_size[:], zf.FileHeader.UncompressedSize64)
-			if !size_ring.Test(buf_size) {
-				// Not a single known file matched size
-				// fmt.Println("Skip (size)", composePath)
-				// ["/path/to", "filename.zip/inside/zip.txt", ....]
-				games <- [5]string{zipDir[len(basePath):], path.Join(zipName, zf.FileHeader.Name), "", "", ""}
-				return nil
-			}
-
-			// Check CRC32 against bloom
-			buf_crc := make([]byte, 4)
-			binary.LittleEndian.PutUint32(buf_crc[:], zf.FileHeader.CRC32)
-			if !crc_ring.Test(buf_crc) {
-				// Not a single known file matched size
-				// fmt.Println("Skip (crc32)", composePath)
-				games <- [5]string{zipDir[len(basePath):], path.Join(zipName, zf.FileHeader.Name), "", "", ""}
-				return nil
-			}
-
-			f, err := zf.Open()
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			h := md5.New()
-			if _, err := io.Copy(h, f); err != nil {
-				return err
-			}
-
-			// Check MD5 against bolt
-			var md5Bucket = "MD5"
-			err = db.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte(md5Bucket))
-				md5 := fmt.Sprintf("%x", h.Sum(nil))
-				v := b.Get([]byte(md5))
-				if v != nil {
-					// fmt.Println("Found", composePath, string(v))
-					values := strings.SplitN(string(v), ";", 2)
-					games <- [5]string{zipDir[len(basePath):], path.Join(zipName, zf.FileHeader.Name), values[1], values[0], md5}
-				} else {
-					games <- [5]string{zipDir[len(basePath):], path.Join(zipName, zf.FileHeader.Name), "", "", ""}
-				}
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
-
-func ScanGames(basePath string, games chan<- [5]string) error {
-
-	defer close(games)
-
-	var bloomBucket = "BLOOM"
-	var md5Bucket = "MD5"
-	var crcKey = "crc"
-	var sizeKey = "size"
-
-	db, err := bolt.Open(pathlib.Join(system.CachePath, "databank.db"), 0600, &bolt.Options{ReadOnly: true})
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	// Load bloom filters
-	crc_ring := new(ring.Ring)
-	size_ring := new(ring.Ring)
-
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bloomBucket))
-		v := b.Get([]byte(crcKey))
-		if v == nil {
-			return errors.New("CRC bloom filter is missing")
-		}
-		crc_ring.UnmarshalBinary(v)
-
-		v = b.Get([]byte(sizeKey))
-		if v == nil {
-			return errors.New("Size bloom filter is missing")
-		}
-		size_ring.UnmarshalBinary(v)
-
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-
-	// Scan path
-	err = fastwalk.Walk(basePath, func(path string, typ os.FileMode) error {
-		if typ.IsDir() {
-			return nil
-		} else if ext := strings.TrimLeft(strings.ToLower(filepath.Ext(path)), "."); ext == "zip" {
-			r, err := zip.OpenReader(path)
-			if err != nil {
-				return err
-			}
-			defer r.Close()
-			return ScanZipForGames(basePath, path, r, db, crc_ring, size_ring, games)
-		} else if IsKnownExt(ext) {
-			info, err := os.Lstat(path)
-			if err != nil {
-				return err
-			}
-			buf_size := make([]byte, 8)
-			binary.LittleEndian.PutUint64(buf_size[:], uint64(info.Size()))
-			if !size_ring.Test(buf_size) {
-				// Not a single known file matched size
-				// fmt.Println("Skip (size)", path)
-				games <- [5]string{pathlib.Dir(path[len(basePath):]), pathlib.Base(path), "", "", ""}
-				return nil
-			}
-
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			h := md5.New()
-			if _, err := io.Copy(h, f); err != nil {
-				return err
-			}
-
-			err = db.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte(md5Bucket))
-				md5 := fmt.Sprintf("%x", h.Sum(nil))
-				v := b.Get([]byte(md5))
-				if v != nil {
-					// fmt.Println("Found", path, string(v))
-					values := strings.SplitN(string(v), ";", 2)
-					games <- [5]string{pathlib.Dir(path[len(basePath):]), pathlib.Base(path), values[1], values[0], md5}
-				} else {
-					games <- [5]string{pathlib.Dir(path[len(basePath):]), pathlib.Base(path), "", "", ""}
-				}
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 /////////////////////////////////////////////////////////////////////////
 //                          Folder Structure                           //
 /////////////////////////////////////////////////////////////////////////
@@ -1111,27 +1309,19 @@ func ScanFoldersAndSave(basePath string, recursive bool) error {
 }
 
 func ScanForFolders(w http.ResponseWriter, r *http.Request) {
-	scanMutex.Lock()
-	defer scanMutex.Unlock()
-
-	scanPathParam, ok := r.URL.Query()["path"]
-	if !ok {
-		return
-	}
-
-	err := ScanFoldersAndSave(scanPathParam[0], true)
-
+	job, err := startScanJob(r, "folders")
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	waitForJob(w, r, job)
 }
 
+// UpdateGameDB downloads the databank again. It waits for the scans, they
+// have the databank open, and the DATs are imported again as the imports do.
 func UpdateGameDB(w http.ResponseWriter, r *http.Request) {
-	err := update.UpdateGameDB()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
-	}
+	job := scanJobs.Start("databank", databank.Path, func(job *jobs.Job) (interface{}, error) {
+		return nil, update.UpdateGameDB()
+	})
+	waitForJob(w, r, job)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	pathlib "path"
+	"reflect"
+	"testing"
+)
+
+func TestScanPathCountsFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cores")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bad := pathlib.Join(dir, "bad.mra")
+	if err := ioutil.WriteFile(bad, []byte("<misterromdescription><name>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The MRA was fine in the previous scan
+	scan := NewCoresScan(&Cores{Version: CoresDBVersion, MRAs: []MRA{{Path: bad}}})
+	fi, err := os.Stat(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ScanPath(dir, fi, scan)
+	scan.Finish()
+
+	if !reflect.DeepEqual(scan.Summary.Failed, []string{bad}) {
+		t.Errorf("failed = %v", scan.Summary.Failed)
+	}
+	if len(scan.Cores.MRAs) != 0 || len(scan.Summary.Changed) != 0 || len(scan.Summary.Removed) != 0 {
+		t.Errorf("summary = %+v, %d MRAs", scan.Summary, len(scan.Cores.MRAs))
+	}
+}
+
+func TestScanMRA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cores")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	arcade := pathlib.Join(dir, "_Arcade", "_Organized")
+	os.MkdirAll(arcade, 0755)
+	p := pathlib.Join(arcade, "Pac-Man (Midway).mra")
+	mra := `<misterromdescription>
+	<name>Pac-Man (Midway)</name>
+	<setname>pacman</setname>
+	<parent>puckman</parent>
+	<year>1980</year>
+	<manufacturer>Namco (Midway license)</manufacturer>
+	<category>Maze</category>
+	<rotation>vertical (ccw)</rotation>
+	<players>2</players>
+	<buttons names="Coin,Start" default="A,B"/>
+	<region>USA</region>
+	<mameversion>0220</mameversion>
+	<rbf>pacman</rbf>
+	<rom index="1"><part>00</part></rom>
+	<rom index="0" zip="pacman.zip|puckman.zip" md5="none">
+		<part name="pacman.6e" crc="c1e6ab10"/>
+		<interleave output="16"><part name="pacman.6f" crc="1a6fb2d4" zip="other.zip"/></interleave>
+	</rom>
+</misterromdescription>`
+	if err := ioutil.WriteFile(p, []byte(mra), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := scanMRA(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{c.Filename, c.Name, c.Setname, c.Parent, c.Year, c.Manufacturer, c.Category, c.Rotation, c.Players, c.Buttons.Names, c.Buttons.Default, c.Region, c.MameVersion, c.Rbf}
+	want := []string{"Pac-Man (Midway).mra", "Pac-Man (Midway)", "pacman", "puckman", "1980", "Namco (Midway license)", "Maze", "vertical (ccw)", "2", "Coin,Start", "A,B", "USA", "0220", "pacman"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("metadata = %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(c.LogicPath, []string{"Arcade", "Organized"}) {
+		t.Errorf("lpath = %q", c.LogicPath)
+	}
+	// Roms without zips are inline data
+	wantRoms := []MRARom{{
+		Zip:        "pacman.zip|puckman.zip",
+		Index:      "0",
+		Parts:      []MRAPart{{Name: "pacman.6e", CRC: "c1e6ab10"}},
+		Interleave: []MRAPart{{Name: "pacman.6f", CRC: "1a6fb2d4", Zip: "other.zip"}},
+	}}
+	if !reflect.DeepEqual(c.Roms, wantRoms) {
+		t.Errorf("roms = %+v, want %+v", c.Roms, wantRoms)
+	}
+	if c.Audit.Status != AuditNoZip || c.RomsFound {
+		t.Errorf("audit = %+v, roms found %v", c.Audit, c.RomsFound)
+	}
+}
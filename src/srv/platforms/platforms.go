@@ -0,0 +1,73 @@
+package platforms
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	_ "github.com/nilp0inter/MiSTer_WebMenu/platforms/statik"
+
+	"github.com/rakyll/statik/fs"
+	"gopkg.in/yaml.v2"
+)
+
+// Platform is the description of a platform from data/platforms.
+type Platform struct {
+	Name        string   `yaml:"name" json:"name"`
+	Shortname   string   `yaml:"shortname" json:"shortname"`
+	Description string   `yaml:"description" json:"description"`
+	Codename    []string `yaml:"codename" json:"codename"`
+	Release     int      `yaml:"release" json:"release"`
+}
+
+// Platforms holds every known platform, sorted by name. It is filled by Load.
+var Platforms = make([]Platform, 0)
+
+var byCodename = make(map[string]*Platform)
+
+// Load reads the platform definitions embedded in the binary.
+func Load() error {
+	statikFS, err := fs.NewWithNamespace("platforms")
+	if err != nil {
+		return err
+	}
+
+	loaded := make([]Platform, 0)
+	err = fs.Walk(statikFS, "/", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".yml" {
+			return nil
+		}
+		b, err := fs.ReadFile(statikFS, path)
+		if err != nil {
+			return err
+		}
+		var p Platform
+		if err := yaml.Unmarshal(b, &p); err != nil {
+			return err
+		}
+		loaded = append(loaded, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Name < loaded[j].Name })
+
+	Platforms = loaded
+	byCodename = make(map[string]*Platform)
+	for i := range Platforms {
+		for _, codename := range Platforms[i].Codename {
+			byCodename[codename] = &Platforms[i]
+		}
+	}
+	return nil
+}
+
+// ByCodename returns the platform a core belongs to.
+func ByCodename(codename string) (*Platform, bool) {
+	p, ok := byCodename[codename]
+	return p, ok
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	pathlib "path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/jobs"
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+)
+
+// StaleCores lists the RBFs superseded by a newer build of the same core.
+type StaleCores struct {
+	RBFs []RBF `json:"rbfs"`
+	Size int64 `json:"size"`
+}
+
+// QuarantinedCore is an RBF moved out of the menu by QuarantineCores.
+type QuarantinedCore struct {
+	Path     string `json:"path"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+// markCurrentRBFs flags the newest build of every codename as current.
+// RBFs without a codename can't be grouped and are always current.
+func markCurrentRBFs(rbfs []RBF) {
+	newest := make(map[string]int)
+	for i := range rbfs {
+		c := &rbfs[i]
+		c.Current = c.Codename == ""
+		if c.Current {
+			continue
+		}
+		j, ok := newest[c.Codename]
+		if !ok || c.Codedate > rbfs[j].Codedate || (c.Codedate == rbfs[j].Codedate && c.Ctime > rbfs[j].Ctime) {
+			newest[c.Codename] = i
+		}
+	}
+	for _, i := range newest {
+		rbfs[i].Current = true
+	}
+}
+
+// RBFGroup is the set of builds of a core found in the SD card.
+type RBFGroup struct {
+	Codename string `json:"codename"`
+	// Path of the newest build
+	Current string `json:"current"`
+	// Paths of the older builds, newest first
+	Older []string `json:"older"`
+}
+
+// groupRBFs groups the builds of every codename, once markCurrentRBFs has
+// flagged the newest ones. RBFs without a codename are left out.
+func groupRBFs(rbfs []RBF) []RBFGroup {
+	builds := make(map[string][]RBF)
+	for _, c := range rbfs {
+		if c.Codename != "" {
+			builds[c.Codename] = append(builds[c.Codename], c)
+		}
+	}
+	groups := make([]RBFGroup, 0, len(builds))
+	for codename, cs := range builds {
+		sort.SliceStable(cs, func(i, j int) bool {
+			if cs[i].Current != cs[j].Current {
+				return cs[i].Current
+			}
+			if cs[i].Codedate != cs[j].Codedate {
+				return cs[i].Codedate > cs[j].Codedate
+			}
+			return cs[i].Ctime > cs[j].Ctime
+		})
+		g := RBFGroup{Codename: codename, Current: cs[0].Path, Older: make([]string, 0, len(cs)-1)}
+		for _, c := range cs[1:] {
+			g.Older = append(g.Older, c.Path)
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Codename < groups[j].Codename })
+	return groups
+}
+
+func quarantinePath(p string) string {
+	return pathlib.Join(system.QuarantinePath, strings.TrimPrefix(p, system.SdPath))
+}
+
+func moveFile(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return errors.New(dst + " already exists")
+	}
+	if err := os.MkdirAll(pathlib.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+func decodePaths(r *http.Request) ([]string, error) {
+	var paths []string
+	if err := json.NewDecoder(r.Body).Decode(&paths); err != nil {
+		return nil, err
+	}
+	for i, p := range paths {
+		paths[i] = pathlib.Clean(p)
+	}
+	return paths, nil
+}
+
+func ListStaleCores(w http.ResponseWriter, r *http.Request) {
+	cores, err := LoadCores()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	markCurrentRBFs(cores.RBFs)
+
+	stale := StaleCores{RBFs: make([]RBF, 0)}
+	for _, c := range cores.RBFs {
+		if !c.Current {
+			stale.RBFs = append(stale.RBFs, c)
+			stale.Size += c.Size
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stale)
+}
+
+func ListQuarantinedCores(w http.ResponseWriter, r *http.Request) {
+	quarantined := make([]QuarantinedCore, 0)
+	err := filepath.Walk(system.QuarantinePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			quarantined = append(quarantined, QuarantinedCore{
+				Path:     pathlib.Join(system.SdPath, strings.TrimPrefix(p, system.QuarantinePath)),
+				Filename: info.Name(),
+				Size:     info.Size(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quarantined)
+}
+
+// QuarantineCores moves the given outdated RBFs into the quarantine folder,
+// keeping their path relative to the SD card so they can be restored.
+func QuarantineCores(w http.ResponseWriter, r *http.Request) {
+	paths, err := decodePaths(r)
+	if err != nil {
+		http.Error(w, "can't decode paths", http.StatusBadRequest)
+		return
+	}
+
+	cores, err := LoadCores()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	markCurrentRBFs(cores.RBFs)
+	stale := make(map[string]bool)
+	for _, c := range cores.RBFs {
+		stale[c.Path] = !c.Current
+	}
+
+	for _, p := range paths {
+		if !stale[p] {
+			http.Error(w, p+" is not an outdated core", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The rescan waits for the running scans
+	job := scanJobs.Start("quarantine", system.QuarantinePath, func(job *jobs.Job) (interface{}, error) {
+		for _, p := range paths {
+			if err := moveFile(p, quarantinePath(p)); err != nil {
+				return nil, err
+			}
+		}
+		return ScanCoresAndSave(true, job)
+	})
+	waitForJob(w, r, job)
+}
+
+// RestoreCores moves quarantined RBFs back to their original location.
+func RestoreCores(w http.ResponseWriter, r *http.Request) {
+	paths, err := decodePaths(r)
+	if err != nil {
+		http.Error(w, "can't decode paths", http.StatusBadRequest)
+		return
+	}
+
+	for _, p := range paths {
+		if !strings.HasPrefix(p, system.SdPath+"/") {
+			http.Error(w, p+" is not in the SD card", http.StatusBadRequest)
+			return
+		}
+	}
+
+	job := scanJobs.Start("restore", system.QuarantinePath, func(job *jobs.Job) (interface{}, error) {
+		for _, p := range paths {
+			if err := moveFile(quarantinePath(p), p); err != nil {
+				return nil, err
+			}
+		}
+		return ScanCoresAndSave(true, job)
+	})
+	waitForJob(w, r, job)
+}
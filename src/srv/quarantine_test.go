@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupRBFs(t *testing.T) {
+	rbfs := []RBF{
+		{Path: "/media/fat/_Console/NES_20200101.rbf", Codename: "NES", Codedate: "20200101"},
+		{Path: "/media/fat/_Console/NES_20210301.rbf", Codename: "NES", Codedate: "20210301"},
+		{Path: "/media/fat/_Console/SNES_20210101.rbf", Codename: "SNES", Codedate: "20210101"},
+		{Path: "/media/fat/_Console/NES_20201231.rbf", Codename: "NES", Codedate: "20201231"},
+		{Path: "/media/fat/_Utility/menu.rbf"},
+	}
+	markCurrentRBFs(rbfs)
+
+	current := make([]bool, len(rbfs))
+	for i, c := range rbfs {
+		current[i] = c.Current
+	}
+	if want := []bool{false, true, true, false, true}; !reflect.DeepEqual(current, want) {
+		t.Errorf("current = %v, want %v", current, want)
+	}
+
+	want := []RBFGroup{
+		{
+			Codename: "NES",
+			Current:  "/media/fat/_Console/NES_20210301.rbf",
+			Older:    []string{"/media/fat/_Console/NES_20201231.rbf", "/media/fat/_Console/NES_20200101.rbf"},
+		},
+		{Codename: "SNES", Current: "/media/fat/_Console/SNES_20210101.rbf", Older: []string{}},
+	}
+	if groups := groupRBFs(rbfs); !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %+v, want %+v", groups, want)
+	}
+}
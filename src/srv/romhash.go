@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
+)
+
+const (
+	// MatchRaw means the databank knows the file as it is.
+	MatchRaw = "raw"
+	// MatchHeaderless means the databank knows the file without its header.
+	MatchHeaderless = "headerless"
+)
+
+// maxHeaderSize is the size of the largest header stripped by romHeaderSize.
+const maxHeaderSize = 512
+
+// ROMHashes are the hashes of a ROM file, with and without its header.
+type ROMHashes struct {
+	Raw        string
+	Headerless string
+	// CRC32 of the whole file
+	CRC string
+	// Size of the header, if any
+	Header int
+	// Hashes stored in the header of CHD images
+	SHA1    string
+	RawSHA1 string
+}
+
+// headerSizes returns the sizes of the headers a ROM with the given extension
+// may carry. No-Intro hashes these ROMs without them.
+func headerSizes(ext string) []uint64 {
+	switch ext {
+	case "nes", "fds":
+		return []uint64{16}
+	case "lnx":
+		return []uint64{64}
+	case "sfc", "smc":
+		return []uint64{512}
+	}
+	return nil
+}
+
+// romHeaderSize detects the header of a ROM from its first bytes.
+func romHeaderSize(ext string, head []byte, size uint64) int {
+	switch {
+	case ext == "nes" && bytes.HasPrefix(head, []byte("NES\x1a")):
+		// iNES and NES 2.0
+		return 16
+	case ext == "fds" && bytes.HasPrefix(head, []byte("FDS\x1a")):
+		// fwNES
+		return 16
+	case ext == "lnx" && bytes.HasPrefix(head, []byte("LYNX")):
+		return 64
+	case (ext == "sfc" || ext == "smc") && size%1024 == 512:
+		// Copier header
+		return 512
+	}
+	return 0
+}
+
+// hashROM computes the MD5 and CRC32 of a ROM and, when a header is
+// detected, the MD5 of the ROM without it.
+func hashROM(r io.Reader, ext string, size uint64) (ROMHashes, error) {
+	var hashes ROMHashes
+
+	head := make([]byte, maxHeaderSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return hashes, err
+	}
+	head = head[:n]
+
+	raw := md5.New()
+	raw.Write(head)
+	crc := crc32.NewIEEE()
+	crc.Write(head)
+	headerless := md5.New()
+	hdr := romHeaderSize(ext, head, size)
+	headerless.Write(head[hdr:])
+
+	w := io.MultiWriter(raw, crc)
+	if hdr > 0 {
+		w = io.MultiWriter(raw, crc, headerless)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return hashes, err
+	}
+
+	hashes.Raw = fmt.Sprintf("%x", raw.Sum(nil))
+	hashes.CRC = fmt.Sprintf("%08x", crc.Sum32())
+	if hdr > 0 {
+		hashes.Header = hdr
+		hashes.Headerless = fmt.Sprintf("%x", headerless.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// maybeKnownSize tells whether the ROM, with or without its header, could be
+// in the databank.
+func maybeKnownSize(bank *databank.DataBank, ext string, size uint64) bool {
+	if bank.MaybeSize(size) {
+		return true
+	}
+	for _, hdr := range headerSizes(ext) {
+		if size > hdr && bank.MaybeSize(size-hdr) {
+			return true
+		}
+	}
+	return false
+}
+
+// identifyROM looks the ROM up in the databank, headerless hash first.
+func identifyROM(bank *databank.DataBank, hashes ROMHashes) (databank.Entry, string, error) {
+	if hashes.Headerless != "" {
+		entry, found, err := bank.LookupMD5(hashes.Headerless)
+		if err != nil || found {
+			return entry, MatchHeaderless, err
+		}
+	}
+	entry, found, err := bank.LookupMD5(hashes.Raw)
+	if err != nil || found {
+		return entry, MatchRaw, err
+	}
+	return entry, "", nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"testing"
+)
+
+func TestRomHeaderSize(t *testing.T) {
+	ines := append([]byte("NES\x1a"), make([]byte, 12)...)
+	tests := []struct {
+		name   string
+		ext    string
+		head   []byte
+		size   uint64
+		header int
+	}{
+		{"iNES", "nes", ines, 16 + 40960, 16},
+		{"headerless NES", "nes", make([]byte, 16), 40960, 0},
+		{"fwNES", "fds", []byte("FDS\x1a\x02"), 16 + 2*65500, 16},
+		{"FDS without header", "fds", []byte("\x01*NINTENDO-HVC*"), 65500, 0},
+		{"Lynx", "lnx", []byte("LYNX\x00"), 64 + 262144, 64},
+		{"SNES copier header", "sfc", make([]byte, 512), 512 + 1048576, 512},
+		{"SNES copier header, smc", "smc", make([]byte, 512), 512 + 524288, 512},
+		{"SNES without header", "sfc", make([]byte, 512), 1048576, 0},
+		{"header of another system", "gb", ines, 16 + 32768, 0},
+		{"short file", "nes", []byte("NE"), 2, 0},
+	}
+	for _, tt := range tests {
+		if header := romHeaderSize(tt.ext, tt.head, tt.size); header != tt.header {
+			t.Errorf("%s: header = %d, want %d", tt.name, header, tt.header)
+		}
+	}
+}
+
+func TestHeaderSizesCoverDetectedHeaders(t *testing.T) {
+	heads := map[string][]byte{
+		"nes": []byte("NES\x1a"),
+		"fds": []byte("FDS\x1a"),
+		"lnx": []byte("LYNX"),
+		"sfc": nil,
+		"smc": nil,
+	}
+	for ext, head := range heads {
+		header := romHeaderSize(ext, head, 512+1024)
+		found := false
+		for _, size := range headerSizes(ext) {
+			found = found || int(size) == header
+		}
+		if header == 0 || !found || header > maxHeaderSize {
+			t.Errorf("%s: header of %d bytes, sizes %v", ext, header, headerSizes(ext))
+		}
+	}
+}
+
+func TestHashROM(t *testing.T) {
+	body := bytes.Repeat([]byte{0xea}, 1024)
+	rom := append(append([]byte("NES\x1a"), make([]byte, 12)...), body...)
+
+	hashes, err := hashROM(bytes.NewReader(rom), "nes", uint64(len(rom)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ROMHashes{
+		Raw:        fmt.Sprintf("%x", md5.Sum(rom)),
+		Headerless: fmt.Sprintf("%x", md5.Sum(body)),
+		CRC:        hashes.CRC,
+		Header:     16,
+	}
+	if hashes != want {
+		t.Errorf("hashes = %+v, want %+v", hashes, want)
+	}
+
+	// Shorter than the largest header
+	hashes, err = hashROM(bytes.NewReader([]byte("abc")), "bin", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes.Raw != fmt.Sprintf("%x", md5.Sum([]byte("abc"))) || hashes.CRC != "352441c2" || hashes.Header != 0 {
+		t.Errorf("hashes = %+v", hashes)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	pathlib "path"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
+	"github.com/nilp0inter/MiSTer_WebMenu/jobs"
+	"github.com/nilp0inter/MiSTer_WebMenu/system"
+	"github.com/nilp0inter/MiSTer_WebMenu/update"
+
+	"github.com/gorilla/mux"
+)
+
+// scanJobs runs the scans one after the other, and not at the same time as
+// the other tasks holding scanMutex.
+var scanJobs = jobs.NewManager(scanMutex, 50)
+
+var errUnknownScan = errors.New("unknown kind of scan")
+
+// startScanJob queues the scan of the given kind with the parameters of the
+// request.
+func startScanJob(r *http.Request, kind string) (*jobs.Job, error) {
+	query := r.URL.Query()
+	switch kind {
+	case "cores":
+		force := query.Get("force") == "1"
+		return scanJobs.Start(kind, system.SdPath, func(job *jobs.Job) (interface{}, error) {
+			return ScanCoresAndSave(force, job)
+		}), nil
+	case "folders":
+		scanPath := query.Get("path")
+		if scanPath == "" {
+			return nil, errors.New("missing path")
+		}
+		return scanJobs.Start(kind, scanPath, func(job *jobs.Job) (interface{}, error) {
+			return nil, ScanFoldersAndSave(scanPath, true)
+		}), nil
+	case "games":
+		scanPath := query.Get("path")
+		if scanPath == "" {
+			return nil, errors.New("missing path")
+		}
+		scanPath = pathlib.Clean(scanPath)
+		workers := runtime.NumCPU()
+		if workersParam := query.Get("workers"); workersParam != "" {
+			var err error
+			workers, err = strconv.Atoi(workersParam)
+			if err != nil || workers < 1 {
+				return nil, errors.New("invalid number of workers")
+			}
+		}
+		return scanJobs.Start(kind, scanPath, func(job *jobs.Job) (interface{}, error) {
+			return ScanGamesAndSave(scanPath, workers, job)
+		}), nil
+	}
+	return nil, errUnknownScan
+}
+
+// ScanGamesAndSave writes the games found under scanPath to the games
+// database, replacing the previous scan of the same folder only when the new
+// one finishes.
+func ScanGamesAndSave(scanPath string, workers int, job *jobs.Job) (ScanStatsReport, error) {
+	stats := &ScanStats{Workers: workers, Started: time.Now()}
+	job.Watch(stats.Progress)
+
+	// Check for databank and download if not present
+	_, err := os.Stat(databank.Path)
+	if os.IsNotExist(err) {
+		err = update.UpdateGameDB()
+		if err != nil {
+			return stats.Report(), err
+		}
+	}
+
+	output := gameScanPath(scanPath)
+	os.MkdirAll(pathlib.Dir(output), 0600)
+
+	previous, err := LoadFingerprintIndex(scanPath)
+	if err != nil && !os.IsNotExist(err) {
+		// Without a valid index every file is hashed again
+		log.Println(scanPath, err)
+	}
+
+	games := make(chan GameRecord)
+	var index *FingerprintIndex
+	var scanErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		index, scanErr = ScanGames(scanPath, stats, previous, job.Cancelled(), games)
+	}()
+
+	// The disks of a game can only be grouped once all of them were found
+	records := make([]GameRecord, 0)
+	for game := range games {
+		records = append(records, game)
+	}
+	<-done
+	if scanErr == nil {
+		groupDiskSets(records)
+		scanErr = WriteGameScan(output, newGameScanHeader(scanPath), records)
+	}
+	gameScanStatsMutex.Lock()
+	report := stats.Report()
+	gameScanStatsMutex.Unlock()
+	if scanErr != nil {
+		return report, scanErr
+	}
+
+	err = SaveFingerprintIndex(scanPath, index)
+	if err != nil {
+		return report, err
+	}
+
+	err = databank.LearnCRCs(learnCRCs(records))
+	if err != nil {
+		// Only the next scans are slower without it
+		log.Println(databank.CRCIndexPath, err)
+	}
+
+	return report, ScanFoldersAndSave("/media", true)
+}
+
+// learnCRCs returns the CRC32 and size of the files identified by their raw
+// MD5. Those are the ones the CRC stored in an archive can identify.
+func learnCRCs(records []GameRecord) []databank.CRCEntry {
+	entries := make([]databank.CRCEntry, 0)
+	for _, r := range records {
+		if r.Matched != MatchRaw || r.Tracks != nil || r.CRC == "" {
+			continue
+		}
+		crc, err := strconv.ParseUint(r.CRC, 16, 32)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, databank.CRCEntry{CRC: uint32(crc), Size: uint64(r.Size), MD5: r.MD5})
+	}
+	return entries
+}
+
+// jobWaitTimeout is how long waitForJob waits, it must answer before the
+// write timeout of the server.
+const jobWaitTimeout = 60 * time.Second
+
+// waitForJob answers the request with the result of job once it finishes.
+// Jobs that take longer are answered with 202 and their status, the client
+// follows them at /api/jobs/{id}. The job goes on when the client leaves.
+func waitForJob(w http.ResponseWriter, r *http.Request, job *jobs.Job) {
+	status := job.Status()
+	w.Header().Set("X-Job-ID", status.ID)
+
+	timeout := time.NewTimer(jobWaitTimeout)
+	defer timeout.Stop()
+	select {
+	case <-job.Done():
+	case <-timeout.C:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job.Status())
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	status = job.Status()
+	switch status.State {
+	case jobs.Failed:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(status.Error))
+	case jobs.Cancelled:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(jobs.ErrCancelled.Error()))
+	default:
+		if status.Result != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status.Result)
+		}
+	}
+}
+
+// StartScanJob starts a scan in the background and returns its job.
+func StartScanJob(w http.ResponseWriter, r *http.Request) {
+	job, err := startScanJob(r, mux.Vars(r)["kind"])
+	if err == errUnknownScan {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// ListJobs returns the running jobs and the last finished ones.
+func ListJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scanJobs.List())
+}
+
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := scanJobs.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "unknown job", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+func CancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := scanJobs.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "unknown job", http.StatusNotFound)
+		return
+	}
+	job.Cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Status())
+}
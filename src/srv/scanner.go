@@ -0,0 +1,536 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	pathlib "path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
+	"github.com/nilp0inter/MiSTer_WebMenu/fastwalk"
+	"github.com/nilp0inter/MiSTer_WebMenu/jobs"
+)
+
+// ScanStats counts the work done by every stage of a game scan.
+type ScanStats struct {
+	Workers  int       `json:"workers"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// Walk stage
+	Files uint64 `json:"files"`
+	// Hash stage
+	Hashed      uint64 `json:"hashed"`
+	HashedBytes uint64 `json:"hashed_bytes"`
+	Skipped     uint64 `json:"skipped"`
+	Reused      uint64 `json:"reused"`
+	Errors      uint64 `json:"errors"`
+	// Lookup stage
+	LookedUp   uint64 `json:"looked_up"`
+	Identified uint64 `json:"identified"`
+
+	// Path of the last file that started to be hashed
+	current atomic.Value
+}
+
+// ScanStatsReport is a snapshot of ScanStats with the throughput of every
+// stage, per second.
+type ScanStatsReport struct {
+	ScanStats
+	Running        bool    `json:"running"`
+	Elapsed        float64 `json:"elapsed"`
+	FilesRate      float64 `json:"files_rate"`
+	HashedRate     float64 `json:"hashed_rate"`
+	HashedByteRate float64 `json:"hashed_byte_rate"`
+	LookedUpRate   float64 `json:"looked_up_rate"`
+	Current        string  `json:"current"`
+}
+
+// Progress returns the counters that matter to the job running the scan.
+func (s *ScanStats) Progress() jobs.Progress {
+	gameScanStatsMutex.Lock()
+	r := s.Report()
+	gameScanStatsMutex.Unlock()
+	return jobs.Progress{
+		Seen:       r.Files,
+		Hashed:     r.Hashed,
+		Identified: r.Identified,
+		Current:    r.Current,
+	}
+}
+
+func (s *ScanStats) Report() ScanStatsReport {
+	r := ScanStatsReport{
+		ScanStats: ScanStats{
+			Workers:     s.Workers,
+			Started:     s.Started,
+			Finished:    s.Finished,
+			Files:       atomic.LoadUint64(&s.Files),
+			Hashed:      atomic.LoadUint64(&s.Hashed),
+			HashedBytes: atomic.LoadUint64(&s.HashedBytes),
+			Skipped:     atomic.LoadUint64(&s.Skipped),
+			Reused:      atomic.LoadUint64(&s.Reused),
+			Errors:      atomic.LoadUint64(&s.Errors),
+			LookedUp:    atomic.LoadUint64(&s.LookedUp),
+			Identified:  atomic.LoadUint64(&s.Identified),
+		},
+	}
+	if current, ok := s.current.Load().(string); ok {
+		r.Current = current
+	}
+	end := s.Finished
+	if end.IsZero() {
+		r.Running = !s.Started.IsZero()
+		end = time.Now()
+	}
+	r.Elapsed = end.Sub(s.Started).Seconds()
+	if r.Elapsed > 0 {
+		r.FilesRate = float64(r.Files) / r.Elapsed
+		r.HashedRate = float64(r.Hashed) / r.Elapsed
+		r.HashedByteRate = float64(r.HashedBytes) / r.Elapsed
+		r.LookedUpRate = float64(r.LookedUp) / r.Elapsed
+	}
+	return r
+}
+
+var gameScanStats = &ScanStats{}
+var gameScanStatsMutex = &sync.Mutex{}
+
+// countingReader adds the number of bytes read to a counter.
+type countingReader struct {
+	r     io.Reader
+	count *uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddUint64(c.count, uint64(n))
+	return n, err
+}
+
+// scanFile is a file found by the walk stage. The size and modification
+// time of a CUE sheet are those of the whole disc.
+type scanFile struct {
+	path   string
+	ext    string
+	size   int64
+	mtime  int64
+	tracks []string
+}
+
+// hashedROM is the output of the hash stage. Known is false when the
+// filters already tell the ROM is not in the databank. Files that did not
+// change since the last scan skip the hash stage and carry the records of
+// the previous scan in cached.
+type hashedROM struct {
+	file   scanFile
+	dir    string
+	name   string
+	member string
+	size   int64
+	stored int64
+	known  bool
+	hashes ROMHashes
+	tracks []ROMHashes
+	cached []GameRecord
+	err    string
+}
+
+var errScanStopped = errors.New("Scan stopped")
+
+type gameScan struct {
+	basePath string
+	bank     *databank.DataBank
+	stats    *ScanStats
+	hashed   chan<- hashedROM
+	stop     <-chan struct{}
+}
+
+func (s *gameScan) emit(h hashedROM) {
+	if h.err != "" {
+		atomic.AddUint64(&s.stats.Errors, 1)
+	} else if h.known {
+		atomic.AddUint64(&s.stats.Hashed, 1)
+	} else {
+		atomic.AddUint64(&s.stats.Skipped, 1)
+	}
+	s.hashed <- h
+}
+
+func (s *gameScan) hashReader(r io.Reader, ext string, size uint64) (ROMHashes, error) {
+	return hashROM(countingReader{r, &s.stats.HashedBytes}, ext, size)
+}
+
+func (s *gameScan) hashZip(sf scanFile) error {
+	file, err := zip.OpenReader(sf.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s.stats.current.Store(sf.path)
+	zipDir := pathlib.Dir(sf.path)
+	zipName := pathlib.Base(sf.path)
+	for _, zf := range file.File {
+		select {
+		case <-s.stop:
+			return errScanStopped
+		default:
+		}
+
+		ext := strings.TrimLeft(strings.ToLower(filepath.Ext(zf.FileHeader.Name)), ".")
+		if !IsKnownExt(ext) {
+			continue
+		}
+		// ["/path/to", "filename.zip/inside/zip.txt", ....]
+		size := zf.FileHeader.UncompressedSize64
+		rom := hashedROM{
+			file:   sf,
+			dir:    zipDir[len(s.basePath):],
+			name:   pathlib.Join(zipName, zf.FileHeader.Name),
+			member: zf.FileHeader.Name,
+			size:   int64(size),
+			stored: int64(zf.FileHeader.CompressedSize64),
+		}
+		needed, err := s.filterMember(rom, ext, zf.FileHeader.CRC32, true)
+		if err != nil {
+			return err
+		}
+		if !needed {
+			continue
+		}
+
+		f, err := zf.Open()
+		if err == nil {
+			rom.hashes, err = s.hashReader(f, ext, size)
+			f.Close()
+		}
+		if err != nil {
+			// A damaged member doesn't prevent reading the others
+			rom.err = err.Error()
+			s.emit(rom)
+			continue
+		}
+		rom.known = true
+		s.emit(rom)
+	}
+	return nil
+}
+
+// hash hashes a file with the reader for its kind. A reader that panics on
+// a malformed file only fails that file.
+func (s *gameScan) hash(sf scanFile) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reading %s: %v", sf.ext, r)
+		}
+	}()
+	switch sf.ext {
+	case "zip":
+		return s.hashZip(sf)
+	case "7z":
+		return s.hash7z(sf)
+	case "gz":
+		return s.hashGzip(sf)
+	case "cue":
+		return s.hashCue(sf)
+	case "chd":
+		return s.hashCHD(sf)
+	}
+	return s.hashFile(sf)
+}
+
+func (s *gameScan) hashFile(sf scanFile) error {
+	s.stats.current.Store(sf.path)
+	rom := hashedROM{file: sf, dir: pathlib.Dir(sf.path[len(s.basePath):]), name: pathlib.Base(sf.path), size: sf.size, stored: sf.size}
+
+	if !maybeKnownSize(s.bank, sf.ext, uint64(sf.size)) {
+		// Not a single known file matched size
+		s.emit(rom)
+		return nil
+	}
+
+	f, err := os.Open(sf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rom.hashes, err = s.hashReader(f, sf.ext, uint64(sf.size))
+	if err != nil {
+		return err
+	}
+	rom.known = true
+	s.emit(rom)
+	return nil
+}
+
+// ScanGames identifies the games under basePath. Files are found by a
+// directory walk, hashed by a pool of workers and then looked up in the
+// databank by a single stage, which sends the results to games. Files that
+// did not change since the scan that built previous are not hashed again.
+// The work done is counted in stats, which also sets the number of workers.
+// Closing cancel stops the scan with jobs.ErrCancelled. The returned index
+// describes the files of this scan.
+func ScanGames(basePath string, stats *ScanStats, previous *FingerprintIndex, cancel <-chan struct{}, games chan<- GameRecord) (*FingerprintIndex, error) {
+
+	defer close(games)
+
+	bank, err := databank.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bank.Close()
+
+	index := NewFingerprintIndex()
+	if info, err := os.Stat(databank.Path); err == nil {
+		index.DataBank = info.ModTime().Unix()
+	}
+	if previous == nil || previous.DataBank != index.DataBank || previous.Version != index.Version {
+		// Matches depend on the databank and records on the scan format,
+		// everything has to be checked again
+		previous = NewFingerprintIndex()
+	}
+
+	workers := stats.Workers
+	gameScanStatsMutex.Lock()
+	gameScanStats = stats
+	gameScanStatsMutex.Unlock()
+	defer func() {
+		gameScanStatsMutex.Lock()
+		stats.Finished = time.Now()
+		gameScanStatsMutex.Unlock()
+	}()
+
+	files := make(chan scanFile, workers)
+	hashed := make(chan hashedROM, workers)
+	stop := make(chan struct{})
+
+	var scanErr error
+	var stopOnce sync.Once
+	fail := func(err error) {
+		stopOnce.Do(func() {
+			scanErr = err
+			close(stop)
+		})
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-cancel:
+			fail(jobs.ErrCancelled)
+		case <-finished:
+		}
+	}()
+
+	// Walk stage
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(files)
+
+		// Files that may be tracks of a CUE sheet wait until every sheet
+		// was found
+		var walkMutex sync.Mutex
+		tracks := make(map[string]bool)
+		deferred := make([]scanFile, 0)
+
+		failed := func(sf scanFile, err error) error {
+			atomic.AddUint64(&stats.Errors, 1)
+			select {
+			case hashed <- hashedROM{
+				file: sf,
+				dir:  pathlib.Dir(sf.path[len(basePath):]),
+				name: pathlib.Base(sf.path),
+				size: sf.size,
+				err:  err.Error(),
+			}:
+				return nil
+			case <-stop:
+				return errScanStopped
+			}
+		}
+		send := func(sf scanFile) error {
+			if fp, ok := previous.Files[sf.path]; ok && fp.Size == sf.size && fp.Mtime == sf.mtime {
+				atomic.AddUint64(&stats.Reused, 1)
+				select {
+				case hashed <- hashedROM{file: sf, cached: fp.Records}:
+					return nil
+				case <-stop:
+					return errScanStopped
+				}
+			}
+			select {
+			case files <- sf:
+				return nil
+			case <-stop:
+				return errScanStopped
+			}
+		}
+
+		err := fastwalk.Walk(basePath, func(path string, typ os.FileMode) error {
+			if typ.IsDir() {
+				return nil
+			}
+			ext := strings.TrimLeft(strings.ToLower(filepath.Ext(path)), ".")
+			if !isArchiveExt(ext) && !IsKnownExt(ext) {
+				return nil
+			}
+			atomic.AddUint64(&stats.Files, 1)
+			sf := scanFile{path: path, ext: ext}
+			info, err := os.Lstat(path)
+			if err != nil {
+				return failed(sf, err)
+			}
+			sf.size = info.Size()
+			sf.mtime = info.ModTime().Unix()
+
+			if ext == "cue" {
+				sf.tracks, err = readCue(path)
+				if err != nil {
+					return failed(sf, err)
+				}
+				walkMutex.Lock()
+				for _, track := range sf.tracks {
+					tracks[track] = true
+				}
+				walkMutex.Unlock()
+
+				// The disc changes when any of its tracks does
+				var size int64
+				for _, track := range sf.tracks {
+					info, err := os.Stat(track)
+					if err != nil {
+						return failed(sf, err)
+					}
+					size += info.Size()
+					if mtime := info.ModTime().Unix(); mtime > sf.mtime {
+						sf.mtime = mtime
+					}
+				}
+				sf.size = size
+			} else if mayBeTrack(ext) {
+				walkMutex.Lock()
+				deferred = append(deferred, sf)
+				walkMutex.Unlock()
+				return nil
+			}
+			return send(sf)
+		})
+		if err == nil {
+			for _, sf := range deferred {
+				if tracks[sf.path] {
+					continue
+				}
+				if err = send(sf); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil && err != errScanStopped {
+			fail(err)
+		}
+	}()
+
+	// Hash stage
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &gameScan{basePath: basePath, bank: bank, stats: stats, hashed: hashed, stop: stop}
+			for sf := range files {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				err := s.hash(sf)
+				if err != nil && err != errScanStopped {
+					// Report the file as damaged and go on with the rest
+					s.emit(hashedROM{
+						file: sf,
+						dir:  pathlib.Dir(sf.path[len(basePath):]),
+						name: pathlib.Base(sf.path),
+						size: sf.size,
+						err:  err.Error(),
+					})
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(hashed)
+	}()
+
+	// Lookup stage
+	damaged := make(map[string]bool)
+	for rom := range hashed {
+		if rom.err != "" {
+			// Damaged files are not indexed so they are read again next time
+			damaged[rom.file.path] = true
+			games <- newGameError(rom)
+			continue
+		}
+		if rom.cached != nil {
+			index.Add(rom.file, rom.cached...)
+			for _, record := range rom.cached {
+				games <- record
+			}
+			continue
+		}
+
+		record := newGameRecord(rom, databank.Entry{}, "")
+		if rom.known {
+			atomic.AddUint64(&stats.LookedUp, 1)
+			var entry databank.Entry
+			var matched string
+			var err error
+			if rom.tracks != nil {
+				entry, matched, err = identifyDisc(bank, rom.tracks)
+			} else if rom.file.ext == "chd" {
+				entry, matched, err = identifyCHD(bank, rom.hashes)
+			} else {
+				entry, matched, err = identifyROM(bank, rom.hashes)
+			}
+			if err != nil {
+				fail(err)
+				continue
+			}
+			if matched != "" {
+				atomic.AddUint64(&stats.Identified, 1)
+			}
+			record = newGameRecord(rom, entry, matched)
+		}
+		index.Add(rom.file, record)
+		games <- record
+	}
+	for path := range damaged {
+		delete(index.Files, path)
+	}
+
+	// A late cancellation can't change the error any more
+	stopOnce.Do(func() {})
+	return index, scanErr
+}
+
+func GetGameScanStats(w http.ResponseWriter, r *http.Request) {
+	gameScanStatsMutex.Lock()
+	report := gameScanStats.Report()
+	gameScanStatsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,978 @@
+// Package sevenzip reads the list of files of 7z archives and extracts them.
+//
+// Only the features found in ROM sets are supported: archives made of
+// folders with a single coder, either copy, LZMA, LZMA2, deflate or bzip2.
+// The list of files, along with their size and CRC32, is read from the
+// header without decompressing them.
+package sevenzip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var signature = []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}
+
+// ErrFormat is returned for files that are not valid 7z archives.
+var ErrFormat = errors.New("sevenzip: not a valid 7z file")
+
+// ErrChecksum is returned when reading a file whose contents don't match its
+// size or CRC32.
+var ErrChecksum = errors.New("sevenzip: checksum error")
+
+// Property IDs
+const (
+	idEnd                   = 0x00
+	idHeader                = 0x01
+	idArchiveProperties     = 0x02
+	idAdditionalStreamsInfo = 0x03
+	idMainStreamsInfo       = 0x04
+	idFilesInfo             = 0x05
+	idPackInfo              = 0x06
+	idUnpackInfo            = 0x07
+	idSubStreamsInfo        = 0x08
+	idSize                  = 0x09
+	idCRC                   = 0x0a
+	idFolder                = 0x0b
+	idCodersUnpackSize      = 0x0c
+	idNumUnpackStream       = 0x0d
+	idEmptyStream           = 0x0e
+	idEmptyFile             = 0x0f
+	idAnti                  = 0x10
+	idName                  = 0x11
+	idEncodedHeader         = 0x17
+)
+
+// Coder IDs
+const (
+	coderCopy    = "\x00"
+	coderLZMA    = "\x03\x01\x01"
+	coderLZMA2   = "\x21"
+	coderDeflate = "\x04\x01\x08"
+	coderBZip2   = "\x04\x02\x02"
+	coderAES     = "\x06\xf1\x07\x01"
+)
+
+// File is a member of an archive.
+type File struct {
+	Name   string
+	Size   uint64
+	CRC32  uint32
+	HasCRC bool
+	IsDir  bool
+
+	hasStream bool
+	folder    int
+}
+
+type coder struct {
+	id         string
+	inStreams  uint64
+	outStreams uint64
+	props      []byte
+}
+
+type folder struct {
+	coders      []coder
+	packStreams uint64
+	unpackSizes []uint64
+	crc         uint32
+	hasCRC      bool
+
+	// Position of the first packed stream in the archive
+	packOffset int64
+	packSize   uint64
+	// Files in the folder, in order
+	files []*File
+}
+
+func (f *folder) unpackSize() uint64 {
+	if len(f.unpackSizes) == 0 {
+		return 0
+	}
+	return f.unpackSizes[len(f.unpackSizes)-1]
+}
+
+type streamsInfo struct {
+	packPos   uint64
+	packSizes []uint64
+	folders   []*folder
+	// Number, sizes and CRCs of the files of every folder
+	substreams []uint64
+	sizes      []uint64
+	crcs       []uint32
+	crcDefined []bool
+}
+
+// Reader gives access to the files of an archive.
+type Reader struct {
+	r       io.ReaderAt
+	File    []*File
+	folders []*folder
+}
+
+// ReadCloser is a Reader that must be closed when no longer needed.
+type ReadCloser struct {
+	Reader
+	f *os.File
+}
+
+// OpenReader opens the 7z archive with the given name.
+func OpenReader(name string) (*ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &ReadCloser{f: f}
+	if err := r.init(f, info.Size()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (rc *ReadCloser) Close() error {
+	return rc.f.Close()
+}
+
+// NewReader reads the header of the 7z archive in r, which has the given
+// size.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	zr := &Reader{}
+	if err := zr.init(r, size); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+func (z *Reader) init(r io.ReaderAt, size int64) error {
+	z.r = r
+
+	start := make([]byte, 32)
+	if _, err := r.ReadAt(start, 0); err != nil {
+		return ErrFormat
+	}
+	if !bytes.Equal(start[:6], signature) {
+		return ErrFormat
+	}
+	if crc32.ChecksumIEEE(start[12:32]) != binary.LittleEndian.Uint32(start[8:]) {
+		return errors.New("sevenzip: bad start header CRC")
+	}
+	offset := binary.LittleEndian.Uint64(start[12:])
+	length := binary.LittleEndian.Uint64(start[20:])
+	if length == 0 {
+		// Empty archive
+		return nil
+	}
+	if offset > uint64(size) || length > uint64(size)-32-offset {
+		return ErrFormat
+	}
+	header := make([]byte, length)
+	if _, err := r.ReadAt(header, int64(32+offset)); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(header) != binary.LittleEndian.Uint32(start[28:]) {
+		return errors.New("sevenzip: bad header CRC")
+	}
+
+	for {
+		b := &buffer{data: header}
+		id, err := b.byte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case idHeader:
+			return z.readHeader(b)
+		case idEncodedHeader:
+			info, err := readStreamsInfo(b)
+			if err != nil {
+				return err
+			}
+			if len(info.folders) == 0 {
+				return ErrFormat
+			}
+			info.locate()
+			f := info.folders[0]
+			rc, err := z.folderReader(f)
+			if err != nil {
+				return err
+			}
+			header, err = ioutil.ReadAll(io.LimitReader(rc, int64(f.unpackSize())))
+			if err != nil {
+				return err
+			}
+			if f.hasCRC && crc32.ChecksumIEEE(header) != f.crc {
+				return errors.New("sevenzip: bad header CRC")
+			}
+		default:
+			return ErrFormat
+		}
+	}
+}
+
+func (z *Reader) readHeader(b *buffer) error {
+	var info *streamsInfo
+	for {
+		id, err := b.byte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case idEnd:
+			return z.assignFiles(info)
+		case idArchiveProperties:
+			if err := skipProperties(b); err != nil {
+				return err
+			}
+		case idAdditionalStreamsInfo:
+			if _, err := readStreamsInfo(b); err != nil {
+				return err
+			}
+		case idMainStreamsInfo:
+			if info, err = readStreamsInfo(b); err != nil {
+				return err
+			}
+			info.locate()
+		case idFilesInfo:
+			if z.File, err = readFilesInfo(b); err != nil {
+				return err
+			}
+		default:
+			return ErrFormat
+		}
+	}
+}
+
+// assignFiles gives every file with contents its folder, size and CRC.
+func (z *Reader) assignFiles(info *streamsInfo) error {
+	if info == nil {
+		info = &streamsInfo{}
+	}
+	z.folders = info.folders
+
+	stream := 0
+	folder := 0
+	left := uint64(0)
+	for _, f := range z.File {
+		f.folder = -1
+		if !f.hasStream {
+			continue
+		}
+		for left == 0 {
+			if folder >= len(info.folders) {
+				return ErrFormat
+			}
+			left = info.substreams[folder]
+			folder++
+		}
+		if stream >= len(info.sizes) {
+			return ErrFormat
+		}
+		f.folder = folder - 1
+		f.Size = info.sizes[stream]
+		f.CRC32 = info.crcs[stream]
+		f.HasCRC = info.crcDefined[stream]
+		info.folders[f.folder].files = append(info.folders[f.folder].files, f)
+		stream++
+		left--
+	}
+	return nil
+}
+
+// locate computes where the packed streams of every folder are.
+func (info *streamsInfo) locate() {
+	offset := int64(32 + info.packPos)
+	pack := 0
+	for _, f := range info.folders {
+		f.packOffset = offset
+		for i := uint64(0); i < f.packStreams && pack < len(info.packSizes); i++ {
+			if i == 0 {
+				f.packSize = info.packSizes[pack]
+			}
+			offset += int64(info.packSizes[pack])
+			pack++
+		}
+	}
+}
+
+// folderReader returns the decompressed contents of a folder.
+func (z *Reader) folderReader(f *folder) (io.Reader, error) {
+	if len(f.coders) != 1 || f.packStreams != 1 {
+		return nil, errors.New("sevenzip: unsupported compression method chain")
+	}
+	c := f.coders[0]
+	packed := bufio.NewReader(io.NewSectionReader(z.r, f.packOffset, int64(f.packSize)))
+	switch c.id {
+	case coderCopy:
+		return packed, nil
+	case coderLZMA:
+		if len(c.props) != 5 {
+			return nil, errors.New("sevenzip: invalid LZMA properties")
+		}
+		// The classic LZMA header is the coder properties and the size
+		header := make([]byte, 13)
+		copy(header, c.props)
+		binary.LittleEndian.PutUint64(header[5:], f.unpackSize())
+		return lzma.NewReader(io.MultiReader(bytes.NewReader(header), packed))
+	case coderLZMA2:
+		if len(c.props) != 1 || c.props[0] > 40 {
+			return nil, errors.New("sevenzip: invalid LZMA2 properties")
+		}
+		dictCap := lzma.MaxDictCap
+		if bits := uint(c.props[0]); bits < 40 {
+			dictCap = (2 | int(bits&1)) << (bits/2 + 11)
+		}
+		if dictCap < lzma.MinDictCap {
+			dictCap = lzma.MinDictCap
+		}
+		return lzma.Reader2Config{DictCap: dictCap}.NewReader2(packed)
+	case coderDeflate:
+		return flate.NewReader(packed), nil
+	case coderBZip2:
+		return bzip2.NewReader(packed), nil
+	case coderAES:
+		return nil, errors.New("sevenzip: encrypted archives are not supported")
+	}
+	return nil, fmt.Errorf("sevenzip: unsupported compression method %x", c.id)
+}
+
+// checksumReader reads the contents of a file, and fails with ErrChecksum
+// at the end when they don't match the size or CRC32 of the file.
+type checksumReader struct {
+	r    io.Reader
+	file *File
+	n    uint64
+	crc  uint32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	c.crc = crc32.Update(c.crc, crc32.IEEETable, p[:n])
+	if err == io.EOF {
+		if c.n != c.file.Size || (c.file.HasCRC && c.crc != c.file.CRC32) {
+			return n, ErrChecksum
+		}
+	}
+	return n, err
+}
+
+// Extract decompresses the files for which want returns true, and calls fn
+// with the contents of each of them, in the order they are stored. Folders
+// without any wanted file are not read at all. Reading a damaged file fails
+// with ErrChecksum, or the error of the decompressor. An error returned by fn
+// stops the extraction.
+func (z *Reader) Extract(want func(*File) bool, fn func(*File, io.Reader) error) error {
+	for _, f := range z.folders {
+		wanted := false
+		for _, file := range f.files {
+			if want(file) {
+				wanted = true
+				break
+			}
+		}
+		if !wanted {
+			continue
+		}
+
+		r, err := z.folderReader(f)
+		if err != nil {
+			return err
+		}
+		for _, file := range f.files {
+			contents := &checksumReader{r: io.LimitReader(r, int64(file.Size)), file: file}
+			if want(file) {
+				if err := fn(file, contents); err != nil {
+					return err
+				}
+			}
+			// Whatever fn didn't read is skipped
+			if _, err := io.Copy(ioutil.Discard, contents); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PackedSize returns the bytes of the archive taken by a file. Files of a
+// solid folder take a share of it proportional to their size.
+func (z *Reader) PackedSize(file *File) uint64 {
+	if file.folder < 0 || file.folder >= len(z.folders) {
+		return 0
+	}
+	f := z.folders[file.folder]
+	unpacked := f.unpackSize()
+	if unpacked == 0 {
+		return 0
+	}
+	if len(f.files) == 1 {
+		return f.packSize
+	}
+	return uint64(float64(f.packSize) * float64(file.Size) / float64(unpacked))
+}
+
+// FolderError tells whether the files of the folder can be extracted,
+// without decompressing them.
+func (z *Reader) FolderError(file *File) error {
+	if file.folder < 0 || file.folder >= len(z.folders) {
+		return nil
+	}
+	f := z.folders[file.folder]
+	if len(f.coders) != 1 || f.packStreams != 1 {
+		return errors.New("sevenzip: unsupported compression method chain")
+	}
+	switch f.coders[0].id {
+	case coderCopy, coderLZMA, coderLZMA2, coderDeflate, coderBZip2:
+		return nil
+	case coderAES:
+		return errors.New("sevenzip: encrypted archives are not supported")
+	}
+	return fmt.Errorf("sevenzip: unsupported compression method %x", f.coders[0].id)
+}
+
+func readStreamsInfo(b *buffer) (*streamsInfo, error) {
+	info := &streamsInfo{}
+	for {
+		id, err := b.byte()
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case idEnd:
+			if info.substreams == nil {
+				// One file per folder
+				for _, f := range info.folders {
+					info.substreams = append(info.substreams, 1)
+					info.sizes = append(info.sizes, f.unpackSize())
+					info.crcs = append(info.crcs, f.crc)
+					info.crcDefined = append(info.crcDefined, f.hasCRC)
+				}
+			}
+			return info, nil
+		case idPackInfo:
+			if err := readPackInfo(b, info); err != nil {
+				return nil, err
+			}
+		case idUnpackInfo:
+			if err := readUnpackInfo(b, info); err != nil {
+				return nil, err
+			}
+		case idSubStreamsInfo:
+			if info.folders == nil {
+				// The files are split from the folders of the unpack info
+				return nil, ErrFormat
+			}
+			if err := readSubStreamsInfo(b, info); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrFormat
+		}
+	}
+}
+
+func readPackInfo(b *buffer, info *streamsInfo) error {
+	var err error
+	if info.packPos, err = b.number(); err != nil {
+		return err
+	}
+	n, err := b.number()
+	if err != nil {
+		return err
+	}
+	if n > uint64(len(b.data)) {
+		return ErrFormat
+	}
+	for {
+		id, err := b.byte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case idEnd:
+			return nil
+		case idSize:
+			info.packSizes = make([]uint64, n)
+			for i := range info.packSizes {
+				if info.packSizes[i], err = b.number(); err != nil {
+					return err
+				}
+			}
+		case idCRC:
+			if _, _, err := readDigests(b, int(n)); err != nil {
+				return err
+			}
+		default:
+			return ErrFormat
+		}
+	}
+}
+
+func readFolder(b *buffer) (*folder, error) {
+	n, err := b.number()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n > 64 {
+		return nil, ErrFormat
+	}
+	f := &folder{}
+	var inStreams, outStreams uint64
+	for i := uint64(0); i < n; i++ {
+		flags, err := b.byte()
+		if err != nil {
+			return nil, err
+		}
+		if flags&0x80 != 0 {
+			return nil, errors.New("sevenzip: alternative methods are not supported")
+		}
+		id, err := b.bytes(int(flags & 0x0f))
+		if err != nil {
+			return nil, err
+		}
+		c := coder{id: string(id), inStreams: 1, outStreams: 1}
+		if flags&0x10 != 0 {
+			if c.inStreams, err = b.number(); err != nil {
+				return nil, err
+			}
+			if c.outStreams, err = b.number(); err != nil {
+				return nil, err
+			}
+			if c.inStreams > 64 || c.outStreams > 64 {
+				return nil, ErrFormat
+			}
+		}
+		if flags&0x20 != 0 {
+			size, err := b.number()
+			if err != nil {
+				return nil, err
+			}
+			if c.props, err = b.bytes(int(size)); err != nil {
+				return nil, err
+			}
+		}
+		inStreams += c.inStreams
+		outStreams += c.outStreams
+		f.coders = append(f.coders, c)
+	}
+	if outStreams == 0 || outStreams-1 > inStreams {
+		return nil, ErrFormat
+	}
+	bindPairs := outStreams - 1
+	for i := uint64(0); i < bindPairs; i++ {
+		if _, err := b.number(); err != nil {
+			return nil, err
+		}
+		if _, err := b.number(); err != nil {
+			return nil, err
+		}
+	}
+	f.packStreams = inStreams - bindPairs
+	if f.packStreams > 1 {
+		for i := uint64(0); i < f.packStreams; i++ {
+			if _, err := b.number(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	f.unpackSizes = make([]uint64, outStreams)
+	return f, nil
+}
+
+func readUnpackInfo(b *buffer, info *streamsInfo) error {
+	id, err := b.byte()
+	if err != nil {
+		return err
+	}
+	if id != idFolder {
+		return ErrFormat
+	}
+	n, err := b.number()
+	if err != nil {
+		return err
+	}
+	if n > uint64(len(b.data)) {
+		return ErrFormat
+	}
+	if external, err := b.byte(); err != nil {
+		return err
+	} else if external != 0 {
+		return errors.New("sevenzip: external folders are not supported")
+	}
+	info.folders = make([]*folder, n)
+	for i := range info.folders {
+		if info.folders[i], err = readFolder(b); err != nil {
+			return err
+		}
+	}
+
+	if id, err = b.byte(); err != nil {
+		return err
+	}
+	if id != idCodersUnpackSize {
+		return ErrFormat
+	}
+	for _, f := range info.folders {
+		for i := range f.unpackSizes {
+			if f.unpackSizes[i], err = b.number(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		id, err := b.byte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case idEnd:
+			return nil
+		case idCRC:
+			crcs, defined, err := readDigests(b, len(info.folders))
+			if err != nil {
+				return err
+			}
+			for i, f := range info.folders {
+				f.crc = crcs[i]
+				f.hasCRC = defined[i]
+			}
+		default:
+			return ErrFormat
+		}
+	}
+}
+
+func readSubStreamsInfo(b *buffer, info *streamsInfo) error {
+	info.substreams = make([]uint64, len(info.folders))
+	for i := range info.substreams {
+		info.substreams[i] = 1
+	}
+
+	id, err := b.byte()
+	if err != nil {
+		return err
+	}
+	if id == idNumUnpackStream {
+		for i := range info.substreams {
+			if info.substreams[i], err = b.number(); err != nil {
+				return err
+			}
+			if info.substreams[i] > uint64(len(b.data)) {
+				return ErrFormat
+			}
+		}
+		if id, err = b.byte(); err != nil {
+			return err
+		}
+	}
+
+	// The size of the last file of a folder is what is left of it
+	for i, f := range info.folders {
+		n := info.substreams[i]
+		if n == 0 {
+			continue
+		}
+		sum := uint64(0)
+		if id == idSize {
+			for j := uint64(1); j < n; j++ {
+				size, err := b.number()
+				if err != nil {
+					return err
+				}
+				info.sizes = append(info.sizes, size)
+				sum += size
+			}
+		}
+		if sum > f.unpackSize() {
+			return ErrFormat
+		}
+		info.sizes = append(info.sizes, f.unpackSize()-sum)
+	}
+	if id == idSize {
+		if id, err = b.byte(); err != nil {
+			return err
+		}
+	}
+
+	// Files alone in a folder with a CRC share it, the others have their own
+	unknown := 0
+	for i, f := range info.folders {
+		if n := info.substreams[i]; n != 1 || !f.hasCRC {
+			unknown += int(n)
+		}
+	}
+	var crcs []uint32
+	var defined []bool
+	for id != idEnd {
+		if id == idCRC {
+			if crcs, defined, err = readDigests(b, unknown); err != nil {
+				return err
+			}
+		} else if err := skipProperty(b); err != nil {
+			return err
+		}
+		if id, err = b.byte(); err != nil {
+			return err
+		}
+	}
+
+	k := 0
+	for i, f := range info.folders {
+		n := info.substreams[i]
+		if n == 1 && f.hasCRC {
+			info.crcs = append(info.crcs, f.crc)
+			info.crcDefined = append(info.crcDefined, true)
+			continue
+		}
+		for j := uint64(0); j < n; j++ {
+			if crcs != nil {
+				info.crcs = append(info.crcs, crcs[k])
+				info.crcDefined = append(info.crcDefined, defined[k])
+			} else {
+				info.crcs = append(info.crcs, 0)
+				info.crcDefined = append(info.crcDefined, false)
+			}
+			k++
+		}
+	}
+	return nil
+}
+
+func readDigests(b *buffer, n int) ([]uint32, []bool, error) {
+	defined, err := readOptionalBits(b, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	crcs := make([]uint32, n)
+	for i := range crcs {
+		if defined[i] {
+			v, err := b.bytes(4)
+			if err != nil {
+				return nil, nil, err
+			}
+			crcs[i] = binary.LittleEndian.Uint32(v)
+		}
+	}
+	return crcs, defined, nil
+}
+
+// readOptionalBits reads a bit vector preceded by a byte telling whether all
+// the bits are set.
+func readOptionalBits(b *buffer, n int) ([]bool, error) {
+	all, err := b.byte()
+	if err != nil {
+		return nil, err
+	}
+	if all == 0 {
+		return readBits(b, n)
+	}
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = true
+	}
+	return bits, nil
+}
+
+func readBits(b *buffer, n int) ([]bool, error) {
+	data, err := b.bytes((n + 7) / 8)
+	if err != nil {
+		return nil, err
+	}
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = data[i/8]&(0x80>>uint(i%8)) != 0
+	}
+	return bits, nil
+}
+
+func readFilesInfo(b *buffer) ([]*File, error) {
+	n, err := b.number()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(b.data)) {
+		return nil, ErrFormat
+	}
+	files := make([]*File, n)
+	for i := range files {
+		files[i] = &File{hasStream: true}
+	}
+	var emptyStream []bool
+	emptyStreams := 0
+	var emptyFile []bool
+	for {
+		id, err := b.byte()
+		if err != nil {
+			return nil, err
+		}
+		if id == idEnd {
+			break
+		}
+		size, err := b.number()
+		if err != nil {
+			return nil, err
+		}
+		data, err := b.bytes(int(size))
+		if err != nil {
+			return nil, err
+		}
+		p := &buffer{data: data}
+		switch id {
+		case idEmptyStream:
+			if emptyStream, err = readBits(p, len(files)); err != nil {
+				return nil, err
+			}
+			emptyStreams = 0
+			for _, empty := range emptyStream {
+				if empty {
+					emptyStreams++
+				}
+			}
+		case idEmptyFile, idAnti:
+			// Both are bit vectors over the empty streams
+			if emptyStream == nil {
+				return nil, ErrFormat
+			}
+			bits, err := readBits(p, emptyStreams)
+			if err != nil {
+				return nil, err
+			}
+			if id == idEmptyFile {
+				emptyFile = bits
+			}
+		case idName:
+			if external, err := p.byte(); err != nil {
+				return nil, err
+			} else if external != 0 {
+				return nil, errors.New("sevenzip: external names are not supported")
+			}
+			for _, f := range files {
+				if f.Name, err = p.utf16String(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if emptyFile != nil && len(emptyFile) != emptyStreams {
+		// The empty streams changed after the empty files were read
+		return nil, ErrFormat
+	}
+	empty := 0
+	for i, f := range files {
+		if emptyStream != nil && emptyStream[i] {
+			// Empty streams are directories unless marked as empty files
+			f.IsDir = emptyFile == nil || !emptyFile[empty]
+			f.hasStream = false
+			empty++
+		}
+	}
+	return files, nil
+}
+
+func skipProperties(b *buffer) error {
+	for {
+		id, err := b.byte()
+		if err != nil {
+			return err
+		}
+		if id == idEnd {
+			return nil
+		}
+		if err := skipProperty(b); err != nil {
+			return err
+		}
+	}
+}
+
+func skipProperty(b *buffer) error {
+	size, err := b.number()
+	if err != nil {
+		return err
+	}
+	_, err = b.bytes(int(size))
+	return err
+}
+
+// buffer decodes the data types of 7z headers.
+type buffer struct {
+	data []byte
+}
+
+func (b *buffer) byte() (byte, error) {
+	if len(b.data) == 0 {
+		return 0, ErrFormat
+	}
+	v := b.data[0]
+	b.data = b.data[1:]
+	return v, nil
+}
+
+func (b *buffer) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(b.data) {
+		return nil, ErrFormat
+	}
+	v := b.data[:n]
+	b.data = b.data[n:]
+	return v, nil
+}
+
+// number reads a variable length integer. The number of leading one bits of
+// the first byte is the number of bytes that follow.
+func (b *buffer) number() (uint64, error) {
+	first, err := b.byte()
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	mask := byte(0x80)
+	for i := uint(0); i < 8; i++ {
+		if first&mask == 0 {
+			high := uint64(first & (mask - 1))
+			return v | high<<(8*i), nil
+		}
+		next, err := b.byte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(next) << (8 * i)
+		mask >>= 1
+	}
+	return v, nil
+}
+
+// utf16String reads a null terminated UTF-16LE string.
+func (b *buffer) utf16String() (string, error) {
+	var chars []uint16
+	for {
+		v, err := b.bytes(2)
+		if err != nil {
+			return "", err
+		}
+		c := binary.LittleEndian.Uint16(v)
+		if c == 0 {
+			return string(utf16.Decode(chars)), nil
+		}
+		chars = append(chars, c)
+	}
+}
@@ -0,0 +1,194 @@
+package sevenzip
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// extractAll extracts the files of the archive for which want returns true,
+// and returns their contents by name.
+func extractAll(t *testing.T, z *Reader, want func(*File) bool) (map[string][]byte, error) {
+	t.Helper()
+	contents := make(map[string][]byte)
+	err := z.Extract(want, func(f *File, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		contents[f.Name] = b
+		return nil
+	})
+	return contents, err
+}
+
+func all(*File) bool { return true }
+
+func TestOpenReader(t *testing.T) {
+	tests := []struct {
+		file   string
+		files  int
+		solid  bool
+		dirs   int
+		empty  int
+		sample string
+		size   uint64
+		crc    uint32
+	}{
+		{"t0.7z", 2, false, 0, 0, "foo", 4, 0x7e3265a8},
+		// Same files, with a compressed header
+		{"t1.7z", 2, false, 0, 0, "foo", 4, 0x7e3265a8},
+		{"lzma2.7z", 10, true, 0, 0, "03", 3305, 0xb8e403c4},
+		{"bzip2.7z", 10, true, 0, 0, "02", 3164, 0x0d9012ba},
+		{"issue87.7z", 3, false, 0, 2, "something.txt", 4, 0x5a82fd08},
+		{"file_and_empty.7z", 2, false, 0, 1, "large", 21, 0},
+		{"empty.7z", 10, false, 5, 5, "", 0, 0},
+	}
+	for _, tt := range tests {
+		z, err := OpenReader("testdata/" + tt.file)
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+
+		if len(z.File) != tt.files {
+			t.Errorf("%s: %d files, want %d", tt.file, len(z.File), tt.files)
+		}
+		dirs, empty := 0, 0
+		folders := make(map[int]bool)
+		for _, f := range z.File {
+			switch {
+			case f.IsDir:
+				dirs++
+			case !f.hasStream:
+				empty++
+			default:
+				folders[f.folder] = true
+			}
+			if f.Name == tt.sample && (f.Size != tt.size || f.CRC32 != tt.crc) {
+				t.Errorf("%s: %s has size %d and CRC %08x, want %d and %08x", tt.file, f.Name, f.Size, f.CRC32, tt.size, tt.crc)
+			}
+		}
+		if dirs != tt.dirs || empty != tt.empty {
+			t.Errorf("%s: %d directories and %d empty files, want %d and %d", tt.file, dirs, empty, tt.dirs, tt.empty)
+		}
+		if solid := len(folders) == 1 && tt.files-dirs-empty > 1; solid != tt.solid {
+			t.Errorf("%s: solid = %v, want %v", tt.file, solid, tt.solid)
+		}
+
+		// Checked against the CRCs of the header while extracting
+		contents, err := extractAll(t, &z.Reader, all)
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+		}
+		if want := tt.files - dirs - empty; len(contents) != want {
+			t.Errorf("%s: extracted %d files, want %d", tt.file, len(contents), want)
+		}
+		z.Close()
+	}
+}
+
+func TestExtractSkipsFiles(t *testing.T) {
+	z, err := OpenReader("testdata/lzma2.7z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+
+	contents, err := extractAll(t, &z.Reader, func(f *File) bool { return f.Name == "03" || f.Name == "07" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) != 2 {
+		t.Fatalf("extracted %d files, want 2", len(contents))
+	}
+	if crc := crc32.ChecksumIEEE(contents["03"]); crc != 0xb8e403c4 {
+		t.Errorf("03 has CRC %08x", crc)
+	}
+}
+
+func TestCorruptArchives(t *testing.T) {
+	t0, err := ioutil.ReadFile("testdata/t0.7z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	badStart := append([]byte(nil), t0...)
+	badStart[12] ^= 0xff
+	badHeader := append([]byte(nil), t0...)
+	badHeader[len(badHeader)-2] ^= 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a 7z file", []byte("PK\x03\x04 not a 7z archive at all")},
+		{"truncated", t0[:len(t0)-10]},
+		{"bad start header CRC", badStart},
+		{"bad header CRC", badHeader},
+	}
+	for _, tt := range tests {
+		if _, err := NewReader(bytes.NewReader(tt.data), int64(len(tt.data))); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	for _, file := range []string{
+		// Substreams without the folders they split
+		"COMPRESS-492.7z",
+		// Empty files given before the empty streams
+		"empty_file_first.7z",
+	} {
+		if _, err := OpenReader("testdata/" + file); err != ErrFormat {
+			t.Errorf("%s: error = %v, want ErrFormat", file, err)
+		}
+	}
+}
+
+func TestExtractDamagedSolidBlock(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/lzma2.7z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damage the second half of the packed stream, the header is kept
+	f := z.folders[0]
+	for i := f.packOffset + int64(f.packSize)/2; i < f.packOffset+int64(f.packSize)-16; i++ {
+		b[i] ^= 0x55
+	}
+
+	contents, err := extractAll(t, z, all)
+	if err == nil {
+		t.Fatal("no error extracting a damaged block")
+	}
+	// The decompressor reads ahead, the damage may stop the first file
+	for name, c := range contents {
+		for _, file := range z.File {
+			if file.Name == name && crc32.ChecksumIEEE(c) != file.CRC32 {
+				t.Errorf("%s was extracted with the wrong contents", name)
+			}
+		}
+	}
+}
+
+func TestChecksumReader(t *testing.T) {
+	file := &File{Name: "foo", Size: 4, CRC32: crc32.ChecksumIEEE([]byte("foo\n")), HasCRC: true}
+	tests := []struct {
+		data string
+		err  error
+	}{
+		{"foo\n", nil},
+		{"bar\n", ErrChecksum},
+		{"foo", ErrChecksum},
+	}
+	for _, tt := range tests {
+		r := &checksumReader{r: io.LimitReader(bytes.NewReader([]byte(tt.data)), int64(file.Size)), file: file}
+		if _, err := ioutil.ReadAll(r); err != tt.err {
+			t.Errorf("%q: error = %v, want %v", tt.data, err, tt.err)
+		}
+	}
+}
@@ -16,3 +16,8 @@ var WebMenuSHPathBackup = path.Join(ScriptsPath, "webmenu_prev.sh")
 // var MamePath = path.Join(SdPath, "_Arcade", "mame")
 // var HBMamePath = path.Join(SdPath, "_Arcade", "hbmame")
 var GamesPath = path.Join(SdPath, "games")
+
+var LaunchMGLPath = path.Join("/tmp", "webmenu.mgl")
+var QuarantinePath = path.Join(CachePath, "quarantine")
+var ArcadeCoresPath = path.Join(SdPath, "_Arcade", "cores")
+var FingerprintsPath = path.Join(CachePath, "fingerprints")
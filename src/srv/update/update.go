@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"path"
 
+	"github.com/nilp0inter/MiSTer_WebMenu/databank"
 	"github.com/nilp0inter/MiSTer_WebMenu/system"
 )
 
@@ -103,7 +104,14 @@ func UpdateGameDB() error {
 	url := "https://github.com/nilp0inter/MiSTer_WebMenu_DataBank/releases/download/latest/databank.db.xz"
 	downloadDB := path.Join(system.CachePath, "databank.db.xz")
 
-	err := downloadFile(downloadDB, url)
+	// The new databank replaces the imported DATs, they are imported again.
+	// It has no CRC32s, importing them fills the CRC index of their platforms.
+	dats, err := databank.ImportedDATs()
+	if err != nil {
+		return err
+	}
+
+	err = downloadFile(downloadDB, url)
 	if err != nil {
 		return err
 	}
@@ -113,5 +121,12 @@ func UpdateGameDB() error {
 		return err
 	}
 
+	for _, dat := range dats {
+		_, err = databank.ImportDAT(dat.File, dat.Platform)
+		if err != nil {
+			return fmt.Errorf("%s: %v", dat.File, err)
+		}
+	}
+
 	return nil
 }
@@ -158,8 +158,11 @@ systemToCoreCodename =
         , ( "Sega - Game Gear", "SMS" )
         , ( "Sega - Master System - Mark III", "SMS" )
         , ( "Sega - SG-1000", "ColecoVision" )
-
-        -- , ( "NEC - PC Engine CD - TurboGrafx-CD", "TurboGrafx16" )
+        , ( "Sega - Mega CD & Sega CD", "MegaCD" )
+        , ( "NEC - PC Engine CD & TurboGrafx CD", "TurboGrafx16" )
+        , ( "Commodore - 64", "C64" )
+        , ( "Commodore - Amiga", "Minimig" )
+        , ( "Apple - II", "Apple-II" )
         ]
 
 
@@ -292,7 +295,7 @@ platformDecoder =
 
 toGame : String -> String -> String -> String -> String -> Game
 toGame path filename name system md5 =
-    if name == "" || system == "" || md5 == "" then
+    if name == "" || system == "" then
         UnrecognizedGame { path = path, filename = filename }
 
     else
@@ -304,12 +307,42 @@ gameDecoder prefix =
     Decode.map5 toGame
         (Decode.map2 (++)
             (Decode.succeed prefix)
-            (Decode.index 0 Decode.string)
+            (Decode.field "dir" Decode.string)
+        )
+        (Decode.field "file" Decode.string)
+        (Decode.oneOf
+            [ Decode.at [ "disk_set", "title" ] Decode.string
+            , Decode.field "name" Decode.string
+            ]
         )
-        (Decode.index 1 Decode.string)
-        (Decode.index 2 Decode.string)
-        (Decode.index 3 Decode.string)
-        (Decode.index 4 Decode.string)
+        (Decode.field "platform" Decode.string)
+        (Decode.field "md5" Decode.string)
+
+
+-- The first line of a game scan is a header with the version of the format.
+-- Games on several disks are listed once, by the disk that boots them.
+
+
+gameScanLineDecoder : String -> Decode.Decoder (Maybe Game)
+gameScanLineDecoder prefix =
+    let
+        firstDisk =
+            Decode.oneOf
+                [ Decode.map ((==) 1) (Decode.at [ "disk_set", "disk" ] Decode.int)
+                , Decode.succeed True
+                ]
+
+        keepFirst first game =
+            if first then
+                Just game
+
+            else
+                Nothing
+    in
+    Decode.oneOf
+        [ Decode.map (always Nothing) (Decode.field "version" Decode.int)
+        , Decode.map2 keepFirst firstDisk (gameDecoder prefix)
+        ]
 
 
 type alias Flags =
@@ -1382,19 +1415,96 @@ decodeStable tag draft prerelease =
 
 syncCores : Bool -> Cmd Msg
 syncCores force =
-    Http.get
-        { url =
-            relative [ "api", "cores", "scan" ]
-                [ int "force"
-                    (if force then
-                        1
+    Task.attempt CoreSyncFinished
+        (runScanJob "cores"
+            [ int "force"
+                (if force then
+                    1
+
+                 else
+                    0
+                )
+            ]
+        )
 
-                     else
-                        0
-                    )
-                ]
-        , expect = Http.expectWhatever CoreSyncFinished
+
+type alias JobStatus =
+    { id : String
+    , state : String
+    , error : String
+    }
+
+
+jobStatusDecoder : Decoder JobStatus
+jobStatusDecoder =
+    Decode.map3 JobStatus
+        (Decode.field "id" Decode.string)
+        (Decode.field "state" Decode.string)
+        (Decode.oneOf [ Decode.field "error" Decode.string, Decode.succeed "" ])
+
+
+jobResolver : Http.Response String -> Result Http.Error JobStatus
+jobResolver response =
+    case response of
+        Http.GoodStatus_ _ body ->
+            Decode.decodeString jobStatusDecoder body
+                |> Result.mapError (Decode.errorToString >> Http.BadBody)
+
+        Http.BadStatus_ _ body ->
+            Err (Http.BadBody body)
+
+        Http.BadUrl_ url ->
+            Err (Http.BadUrl url)
+
+        Http.Timeout_ ->
+            Err Http.Timeout
+
+        Http.NetworkError_ ->
+            Err Http.NetworkError
+
+
+-- Scans run as jobs in the backend, they are followed until they finish.
+
+
+runScanJob : String -> List Url.Builder.QueryParameter -> Task.Task Http.Error ()
+runScanJob kind params =
+    Http.task
+        { method = "POST"
+        , headers = []
+        , url = relative [ "api", "jobs", "scan", kind ] params
+        , body = Http.emptyBody
+        , timeout = Nothing
+        , resolver = Http.stringResolver jobResolver
         }
+        |> Task.andThen followJob
+
+
+followJob : JobStatus -> Task.Task Http.Error ()
+followJob job =
+    case job.state of
+        "done" ->
+            Task.succeed ()
+
+        "failed" ->
+            Task.fail (Http.BadBody job.error)
+
+        "cancelled" ->
+            Task.fail (Http.BadBody "Job cancelled")
+
+        _ ->
+            Process.sleep 1000
+                |> Task.andThen
+                    (\_ ->
+                        Http.task
+                            { method = "GET"
+                            , headers = []
+                            , url = relative [ "api", "jobs", job.id ] []
+                            , body = Http.emptyBody
+                            , timeout = Nothing
+                            , resolver = Http.stringResolver jobResolver
+                            }
+                    )
+                |> Task.andThen followJob
 
 
 boolToScanStatus : Bool -> ScanStatus
@@ -1422,20 +1532,14 @@ gameTreeDecoder =
 
 syncGameFolder : Cmd Msg
 syncGameFolder =
-    Http.get
-        { url =
-            relative [ "api", "folder", "scan" ] [ string "path" "/media" ]
-        , expect = Http.expectWhatever GameFolderScanFinished
-        }
+    Task.attempt GameFolderScanFinished
+        (runScanJob "folders" [ string "path" "/media" ])
 
 
 scanForGamesInFolder : String -> Cmd Msg
 scanForGamesInFolder path =
-    Http.get
-        { url =
-            relative [ "api", "games", "scan" ] [ string "path" path ]
-        , expect = Http.expectWhatever GameScanFinished
-        }
+    Task.attempt GameScanFinished
+        (runScanJob "games" [ string "path" path ])
 
 
 deleteGameScan : String -> Cmd Msg
@@ -1518,7 +1622,7 @@ loadGameScan : String -> Cmd Msg
 loadGameScan scan =
     Http.get
         { url = relative [ "cached", "games", scan ++ ".jsonl" ] []
-        , expect = expectJsonLines (GotGameScan scan) (gameDecoder scan)
+        , expect = expectJsonLines (GotGameScan scan << Result.map (List.filterMap identity)) (gameScanLineDecoder scan)
         }
 
 
@@ -1533,8 +1637,8 @@ loadCore lpath =
 loadContent : ContentLoadInfo -> Cmd Msg
 loadContent info =
     Http.post
-        { url = relative [ "api", "script", "run" ] []
-        , body = Http.jsonBody (loadScriptEncoder info)
+        { url = relative [ "api", "games", "launch" ] []
+        , body = Http.jsonBody (launchEncoder info)
         , expect = Http.expectWhatever GameLoaded
         }
 
@@ -3034,6 +3138,16 @@ loadScriptEncoder info =
         info.script
 
 
+launchEncoder : ContentLoadInfo -> Value
+launchEncoder info =
+    Encode.object
+        [ ( "core_codename", Encode.string info.coreCodeName )
+        , ( "core_path", Encode.string info.corePath )
+        , ( "rom", Encode.string info.rom )
+        , ( "is_zip", Encode.bool info.isZip )
+        ]
+
+
 scriptCallEncoder : List ( String, Value ) -> String -> Value
 scriptCallEncoder params source =
     Encode.object